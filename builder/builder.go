@@ -30,6 +30,8 @@ func New(env vos.Env, namespace string, gomod bool) (*Builder, error) {
 // existing gopath, so existing imports will still work.
 // Remember to defer the Cleanup() method to delete the temporary files.
 func NewGoRoot(env vos.Env, namespace string) (*Builder, error) {
+	state, wd := vos.Snapshot(env), getwd()
+
 	gopath, err := ioutil.TempDir("", "go")
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating temporary gopath root dir")
@@ -49,6 +51,8 @@ func NewGoRoot(env vos.Env, namespace string) (*Builder, error) {
 		root:      root,
 		namespace: namespace,
 		gomod:     false,
+		state:     state,
+		wd:        wd,
 	}
 
 	if err := os.Mkdir(filepath.Join(gopath, "src"), os.FileMode(0777)); err != nil {
@@ -81,6 +85,8 @@ func NewGoRoot(env vos.Env, namespace string) (*Builder, error) {
 // NewGoModule creates a new go module root in the system temporary location, creates the root dir
 // and the go.mod file. Remember to defer the Cleanup() method to delete the temporary files.
 func NewGoModule(env vos.Env, namespace string) (*Builder, error) {
+	state, wd := vos.Snapshot(env), getwd()
+
 	root, err := ioutil.TempDir("", "go")
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating temporary gopath root dir")
@@ -98,14 +104,17 @@ func NewGoModule(env vos.Env, namespace string) (*Builder, error) {
 		root:      root,
 		namespace: namespace,
 		gomod:     true,
+		state:     state,
+		wd:        wd,
 	}
 
-	err = b.env.Setenv("GOPATH", "")
+	err = b.env.Unsetenv("GOPATH")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	gomodFile := fmt.Sprintf("module %s", namespace)
+	// the go directive stops the go tool adding one when run with -mod=mod
+	gomodFile := fmt.Sprintf("module %s\n\ngo 1.12\n", namespace)
 	err = ioutil.WriteFile(
 		filepath.Join(root, "go.mod"), []byte(gomodFile), os.FileMode(0666))
 	if err != nil {
@@ -122,11 +131,13 @@ func NewGoModule(env vos.Env, namespace string) (*Builder, error) {
 // Builder can be used in testing to create a temporary go module or gopath, src, namespace
 // and package directory, and populate it with source files.
 type Builder struct {
-	env       vos.Env // mockable environment
-	gopath    string  // temporary gopath root dir
-	root      string  // temporary root dir for namespace
-	namespace string  // temporary namespace
-	gomod     bool    // gomodules enabled or not
+	env       vos.Env    // mockable environment
+	gopath    string     // temporary gopath root dir
+	root      string     // temporary root dir for namespace
+	namespace string     // temporary namespace
+	gomod     bool       // gomodules enabled or not
+	state     *vos.State // environment before the builder changed it
+	wd        string     // process working dir before the builder changed it
 }
 
 // Root returns the temporary gopath root dir.
@@ -166,7 +177,22 @@ func (b *Builder) Package(packageName string, files map[string]string) (packageP
 	return path.Join(b.namespace, packageName), dir, nil
 }
 
-// Cleanup deletes all temporary files.
+// Cleanup deletes all temporary files, and restores the environment and
+// working dir to how they were before the builder was created.
 func (b *Builder) Cleanup() {
+	_ = b.state.Restore()
+	if b.wd != "" {
+		_ = os.Chdir(b.wd)
+	}
 	_ = os.RemoveAll(b.root)
+	if b.gopath != "" {
+		_ = os.RemoveAll(b.gopath)
+	}
+}
+
+// getwd returns the process working dir, or an empty string if it can't be
+// found.
+func getwd() string {
+	wd, _ := os.Getwd()
+	return wd
 }
@@ -1,10 +1,11 @@
 package patsy
 
 import (
-	"path"
+	"go/build"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dave/patsy/vos"
 	"github.com/pkg/errors"
@@ -12,188 +13,858 @@ import (
 
 // NewCache returns a new *Cache, allowing cached access to patsy utility
 // functions.
-func NewCache(env vos.Env) *Cache {
-	return &Cache{
-		env:       env,
-		dirm:      new(sync.RWMutex),
-		dirsm:     new(sync.RWMutex),
-		pathm:     new(sync.RWMutex),
-		namem:     new(sync.RWMutex),
-		dirCache:  make(map[keyWithDir]string),
-		dirsCache: make(map[keyWithDir]map[string]string),
-		pathCache: make(map[keyWithDir]string),
-		nameCache: make(map[keyWithDir]string),
+func NewCache(env vos.Env, options ...Option) *Cache {
+	c := &Cache{
+		env:    env,
+		dirs:   Dirs,
+		name:   Name,
+		clock:  realClock{},
+		modm:   new(sync.Mutex),
+		watchm: new(sync.Mutex),
+		subs:   make(map[int]func(Event)),
+		storem: new(sync.Mutex),
+		counters: map[string]*counters{
+			DirMethod:     new(counters),
+			DirsMethod:    new(counters),
+			PathMethod:    new(counters),
+			NameMethod:    new(counters),
+			PreloadMethod: new(counters),
+			GoEnvMethod:   new(counters),
+		},
+	}
+	c.checkInterval = defaultCheckInterval
+	c.path = func(env vos.Env, dir string) (string, error) {
+		return lookupPath(env, dir, c.goEnv)
+	}
+	for _, option := range options {
+		option(c)
+	}
+	c.tables = map[string]*table{
+		DirMethod:  newTable(c.maxEntries, c.ttl, c.clock),
+		DirsMethod: newTable(c.maxEntries, c.ttl, c.clock),
+		PathMethod: newTable(c.maxEntries, c.ttl, c.clock),
+		NameMethod: newTable(c.maxEntries, c.ttl, c.clock),
+	}
+	c.notFound = map[string]*table{
+		DirMethod:  newTable(c.maxEntries, c.notFoundTTL, c.clock),
+		PathMethod: newTable(c.maxEntries, c.notFoundTTL, c.clock),
+	}
+	// the state kept for each working dir is bounded in the same way, so a
+	// process that sees many working dirs doesn't grow without limit
+	c.modCache = newLRU(c.maxEntries, c.ttl, c.clock)
+	c.dirCache = newLRU(c.maxEntries, c.ttl, c.clock)
+	c.storeKeys = newLRU(c.maxEntries, c.ttl, c.clock)
+	c.loaded = newLRU(c.maxEntries, c.ttl, c.clock)
+	c.preloaded = newLRU(c.maxEntries, c.ttl, c.clock)
+	return c
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithStore backs the Cache with a persistent on-disk Store, so results can be
+// shared across process invocations.
+func WithStore(s *Store) Option {
+	return func(c *Cache) {
+		c.store = s
+	}
+}
+
+// WithMaxEntries limits each of the Cache's maps to n entries, so it bounds the
+// whole Cache: the entries of each method, and the state kept for each working
+// dir (the fingerprints of its module configuration files, its store file and
+// whether it has been preloaded). When a map is full the least recently used
+// entry is evicted. A dir entry and the path entry that maps back to it are
+// always evicted together. When the fingerprints governing a working dir are
+// evicted, the entries cached for it are discarded too, since changes to the
+// files could no longer be seen.
+func WithMaxEntries(n int) Option {
+	return func(c *Cache) {
+		c.maxEntries = n
+	}
+}
+
+// WithTTL expires entries d after they were cached, and the state kept for
+// each working dir d after it was last checked.
+func WithTTL(d time.Duration) Option {
+	return func(c *Cache) {
+		c.ttl = d
+	}
+}
+
+// WithNotFoundTTL caches the errors returned by Dir and Path when a package or
+// dir is not found (see IsNotFound) for d. By default they are not cached.
+// Cached errors are discarded by Forget, Reset, module configuration changes
+// and Watch in the same way as other entries, and any change in a watched
+// tree discards all cached Dir errors.
+func WithNotFoundTTL(d time.Duration) Option {
+	return func(c *Cache) {
+		c.notFoundTTL = d
+	}
+}
+
+// defaultCheckInterval is how often the module configuration files governing
+// each working dir are checked, unless set with WithCheckInterval.
+const defaultCheckInterval = time.Second
+
+// WithCheckInterval checks the module configuration files governing each
+// working dir (see Cache) at most once every d, so a change to them may not be
+// seen for up to d. While the Cache is watching (see Watch), the dirs holding
+// the files are watched too, and any change event causes them to be checked on
+// the next lookup. The default is one second. With d of 0 the files are
+// checked on every lookup, including hits, which costs several filesystem
+// calls per lookup.
+func WithCheckInterval(d time.Duration) Option {
+	return func(c *Cache) {
+		c.checkInterval = d
+	}
+}
+
+// WithClock sets the Clock used to expire entries. The default is the system
+// clock.
+func WithClock(clock Clock) Option {
+	return func(c *Cache) {
+		c.clock = clock
 	}
 }
 
-// depending on the cwdir results can vary, so we include the directory in the cache keys
-type keyWithDir struct {
-	key string
-	dir  string
+// entryKey identifies a cache entry. Results vary with the Go environment and
+// the directory a lookup is resolved from, so every entry is keyed by a hash of
+// the environment and that directory as well as the argument of the lookup.
+// The directory is the working dir for Dir, Dirs and Path, and the src dir for
+// Name, which resolves packages from there. Unless the argument is relative to
+// it, the directory is replaced by its scope (see scope), so lookups from
+// different dirs in a module share entries.
+type entryKey struct {
+	goenv string
+	wd    string
+	arg   string
 }
 
 // Cache supports patsy.Dir and patsy.Path, but cached so they can be used in
-// tight loops without hammering the filesystem.
+// tight loops without hammering the filesystem. Cached results are always the
+// same as the results of the uncached functions.
+//
+// The module configuration files (go.mod, go.sum, go.work and
+// vendor/modules.txt) governing each working dir are fingerprinted, and when
+// they change the entries cached for that working dir are discarded. Entries
+// are also keyed by the Go environment variables (e.g. GOPATH, GO111MODULE,
+// GOFLAGS and GOOS) and the go env config file written by `go env -w`, so
+// changing them never returns stale results.
+//
+// Entries are shared by all working dirs in the same module, or in GOPATH mode
+// by all working dirs that see the same vendor dirs, unless the lookup is
+// relative to the working dir (e.g. "./...").
+//
+// The files are checked at most once a second, so a change may not be seen for
+// up to a second, unless the Cache is watching. See WithCheckInterval to check
+// them on every lookup.
+//
+// See Watch to also discard entries when package directories change. See
+// WithMaxEntries and WithTTL to bound the size of the Cache, Stats and
+// WithObserver for instrumentation, and Preload and WithPreload to fill the
+// Cache in bulk.
 type Cache struct {
-	env       vos.Env
-	dirm      *sync.RWMutex
-	dirsm     *sync.RWMutex
-	pathm     *sync.RWMutex
-	namem     *sync.RWMutex
-	dirCache  map[keyWithDir]string
-	dirsCache map[keyWithDir]map[string]string
-	pathCache map[keyWithDir]string
-	nameCache map[keyWithDir]string
+	env           vos.Env
+	dirs          func(vos.Env, string) (map[string]string, error)
+	path          func(vos.Env, string) (string, error)
+	name          func(vos.Env, string, string) (string, error)
+	flight        group
+	maxEntries    int
+	ttl           time.Duration
+	clock         Clock
+	tables        map[string]*table // keyed by method
+	notFound      map[string]*table // not found errors for Dir and Path, keyed by method
+	notFoundTTL   time.Duration
+	modm          *sync.Mutex
+	modCache      *lru // fingerprints keyed by scope
+	dirCache      *lru // the last check (a *dirCheck) of each dir
+	checkInterval time.Duration
+	watchm        *sync.Mutex
+	watcher       watcher
+	subs          map[int]func(Event)
+	nextSub       int
+	store         *Store
+	storem        *sync.Mutex
+	storeKeys     *lru     // store file key for each environment and working dir
+	loaded        *lru     // store file keys that have been loaded, keyed by arg
+	preload       []string // patterns to preload in the background, if not nil
+	preloaded     *lru     // environments and working dirs a background preload has started for
+	counters      map[string]*counters
+	observer      Observer
+}
+
+// Forget discards all entries for the package path provided, including the
+// entries that map its directory back to it.
+func (c *Cache) Forget(ppath string) {
+	c.forget(filter{path: func(p string) bool { return p == ppath }, store: true})
+}
+
+// ForgetPrefix discards all entries for the package path provided and all
+// package paths under it, e.g. "github.com/dave" matches "github.com/dave/foo"
+// but not "github.com/davey".
+func (c *Cache) ForgetPrefix(prefix string) {
+	c.forget(filter{path: func(p string) bool {
+		return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+	}, store: true})
+}
+
+// ForgetDir discards all entries for the package directory provided, including
+// the entries that map its package path back to it.
+func (c *Cache) ForgetDir(dir string) {
+	dir = filepath.Clean(dir)
+	c.forget(filter{dir: func(d string) bool { return filepath.Clean(d) == dir }, store: true})
+}
+
+// ForgetWorkingDir discards all entries that were cached when the working dir
+// (or the src dir for Name) was wd. Entries are shared by all dirs in the same
+// module or vendor scope (see Cache), so they are discarded for those dirs too.
+func (c *Cache) ForgetWorkingDir(wd string) {
+	c.modm.Lock()
+	var last dirCheck
+	if v, ok, _ := c.dirCache.get(entryKey{wd: wd}); ok {
+		last = *v.(*dirCheck)
+	}
+	fp, _ := refresh(c.env, last.fp, configFiles(c.env, wd))
+	sc := scope(c.env, wd, fp)
+	c.dirCache.remove(entryKey{wd: wd})
+	c.modCache.remove(entryKey{wd: sc})
+	c.unpreload(wd)
+	c.unpreload(sc)
+	c.modm.Unlock()
+	c.forget(filter{wd: func(d string) bool { return d == wd || d == sc }, store: true})
+}
+
+// Reset discards all entries.
+func (c *Cache) Reset() {
+	for _, t := range c.tables {
+		t.clear()
+	}
+	for _, t := range c.notFound {
+		t.clear()
+	}
+
+	c.modm.Lock()
+	c.modCache.clear()
+	c.dirCache.clear()
+	c.preloaded.clear()
+	c.modm.Unlock()
 }
 
 // Name does the same as patsy.Name but cached.
 func (c *Cache) Name(packagePath, srcDir string) (string, error) {
-	// check the cache first
-	if n, ok := c.getName(keyWithDir{key: packagePath, dir: srcDir}); ok {
-		return n, nil
+	srcDir, err := c.env.Abs(srcDir)
+	if err != nil {
+		return "", errors.WithStack(err)
 	}
-	n, err := Name(c.env, packagePath, srcDir)
+	goenv, sc := c.check(srcDir)
+	k := keyFor(goenv, srcDir, sc, packagePath, build.IsLocalImport(packagePath))
+	v, err := c.resolve(NameMethod, k, func() (record, error) {
+		n, err := c.name(c.env, packagePath, srcDir)
+		return record{Value: n}, err
+	})
 	if err != nil {
 		return "", err
 	}
-	c.setName(keyWithDir{key: packagePath, dir: srcDir}, n)
-	return n, nil
+	return v.(string), nil
 }
 
 // Path does the same as patsy.Path but cached.
 func (c *Cache) Path(dir string) (string, error) {
-	// check the cache first
-	if ppath, ok := c.getPath(dir); ok {
-		return ppath, nil
-	}
-	ppath, err := Path(c.env, dir)
+	dir = filepath.Clean(dir)
+	k := c.checkWd(dir, !filepath.IsAbs(dir))
+	v, err := c.resolve(PathMethod, k, func() (record, error) {
+		ppath, err := c.path(c.env, dir)
+		if err != nil {
+			return record{}, err
+		}
+		// Path evaluates symlinks, so the dir that maps back to ppath is the
+		// evaluated dir
+		resolved, err := c.env.EvalSymlinks(dir)
+		if err != nil {
+			resolved = ""
+		}
+		return record{Value: ppath, Dir: resolved}, nil
+	})
 	if err != nil {
 		return "", err
 	}
-	c.setDir(ppath, dir)
-	c.setPath(dir, ppath)
-	return ppath, nil
+	return v.(string), nil
 }
 
 // Dir does the same as patsy.Dir but cached.
 func (c *Cache) Dir(ppath string) (string, error) {
-	// check the cache first
-	if dir, ok := c.getDir(ppath); ok {
-		return dir, nil
+	k := c.checkWd(ppath, build.IsLocalImport(ppath))
+	v, ok, err := c.cached(DirMethod, k)
+	if ok {
+		if err != nil {
+			return "", err
+		}
+		return v.(string), nil
 	}
+
+	// use Dirs internally to find the directory, which caches the dir
 	dirs, err := c.Dirs(ppath)
-	if err != nil {
-		return "", err
+	if err == nil {
+		dir, ok := dirs[ppath]
+		if ok {
+			return dir, nil
+		}
 	}
-	dir, ok := dirs[ppath]
-	if !ok {
-		return "", errors.Errorf("Dir not found for %s", ppath)
+
+	// The same fallback as patsy.Dir for empty package dirs
+	if dir, ok := gopathDir(c.env, c.goEnv(c.env).GOPATH, ppath); ok {
+		c.save(record{Method: DirMethod, Env: k.goenv, Wd: k.wd, Key: ppath, Value: dir})
+		return dir, nil
 	}
-	return dir, nil
+
+	if err != nil && !isListError(err) {
+		// only cache the result once go list has run
+		return "", err
+	}
+	err = errors.WithStack(&NotFoundError{Path: ppath})
+	c.setNotFound(DirMethod, k, err)
+	return "", err
 }
 
 // Dirs does the same as patsy.Dirs but cached.
 func (c *Cache) Dirs(ppath string) (map[string]string, error) {
-	// check the cache first
-	if dirs, ok := c.getDirs(ppath); ok {
-		return dirs, nil
-	}
-	dirs, err := Dirs(c.env, ppath)
+	k := c.checkWd(ppath, build.IsLocalImport(ppath))
+	v, err := c.resolve(DirsMethod, k, func() (record, error) {
+		dirs, err := c.dirs(c.env, ppath)
+		return record{Dirs: dirs}, err
+	})
 	if err != nil {
 		return nil, err
 	}
-	c.setDirs(ppath, dirs)
-
-	for importPath, dir := range dirs {
-		c.setDir(importPath, dir)
-		c.setPath(dir, importPath)
-	}
-	return dirs, nil
+	return v.(map[string]string), nil
 }
 
 // GoName converts a full filepath to a package path and filename:
-//     /Users/dave/go/src/github.com/dave/foo.go -> github.com/dave/foo.go
+//
+//	/Users/dave/go/src/github.com/dave/foo.go -> github.com/dave/foo.go
 func (c *Cache) GoName(fpath string) (string, error) {
-	fdir, fname := filepath.Split(fpath)
-	ppath, err := c.Path(fdir)
+	names, err := c.GoNames([]string{fpath})
 	if err != nil {
 		return "", err
 	}
-	return path.Join(ppath, fname), nil
+	return names[0], nil
+}
+
+// GoNames does the same as patsy.GoNames but cached.
+func (c *Cache) GoNames(fpaths []string) ([]string, error) {
+	return goNames(fpaths, c.Path)
 }
 
 // FilePath converts a package path and filename to a full filepath:
-//     github.com/dave/foo.go -> /Users/dave/go/src/github.com/dave/foo.go
+//
+//	github.com/dave/foo.go -> /Users/dave/go/src/github.com/dave/foo.go
 func (c *Cache) FilePath(gpath string) (string, error) {
-	ppath, fname := path.Split(gpath)
-	ppath = strings.TrimSuffix(ppath, "/")
-
-	fdirs, err := c.Dirs(ppath)
+	fpaths, err := c.FilePaths([]string{gpath})
 	if err != nil {
 		return "", err
 	}
-	fdir, ok := fdirs[ppath]
+	return fpaths[0], nil
+}
+
+// FilePaths does the same as patsy.FilePaths but cached.
+func (c *Cache) FilePaths(gpaths []string) ([]string, error) {
+	return filePaths(gpaths, c.Dir)
+}
+
+// resolve returns the cached value for k, or on a miss calls fn and caches the
+// record it returns. fn only needs to fill in the result fields of the record.
+// Concurrent misses for the same entry share a single call to fn.
+func (c *Cache) resolve(method string, k entryKey, fn func() (record, error)) (interface{}, error) {
+	v, ok, err := c.cached(method, k)
+	if ok {
+		return v, err
+	}
+	return c.flight.do(method+"\x00"+k.goenv+"\x00"+k.wd+"\x00"+k.arg, func() (interface{}, error) {
+		var r record
+		var err error
+		c.command(method, k, func() error {
+			r, err = fn()
+			return err
+		})
+		if err != nil {
+			if IsNotFound(err) {
+				c.setNotFound(method, k, err)
+			}
+			return nil, err
+		}
+		r.Method, r.Env, r.Wd, r.Key = method, k.goenv, k.wd, k.arg
+		c.save(r)
+		return r.value(), nil
+	})
+}
+
+// cached returns the cached result for k, and records the lookup. A cached
+// not found result is returned as its error.
+func (c *Cache) cached(method string, k entryKey) (v interface{}, ok bool, err error) {
+	v, ok = c.get(method, k)
 	if !ok {
-		return "", errors.Errorf("Dir not found for %s", gpath)
+		if t := c.notFound[method]; t != nil {
+			var e interface{}
+			if e, ok, _ = t.get(k); ok {
+				err = e.(error)
+			}
+		}
+	}
+	c.lookup(method, k, ok)
+	return v, ok, err
+}
+
+// setNotFound caches a not found result, if enabled by WithNotFoundTTL. The
+// dir of a Path result is watched, so the result is discarded when the dir
+// changes.
+func (c *Cache) setNotFound(method string, k entryKey, err error) {
+	if c.notFoundTTL <= 0 {
+		return
 	}
+	c.notFound[method].set(k, err, c.clock.Now())
+	if method == PathMethod {
+		c.watchDir(k.arg)
+	}
+}
 
-	return filepath.Join(fdir, fname), nil
+// checkWd checks the module configuration files governing the current working
+// dir, and returns the key for arg looked up from the working dir. Local args
+// are relative to the working dir. See check.
+func (c *Cache) checkWd(arg string, local bool) entryKey {
+	wd, err := c.env.Getwd()
+	if err != nil {
+		return entryKey{goenv: envHash(c.env), arg: arg}
+	}
+	goenv, sc := c.check(wd)
+	if c.preload != nil {
+		c.startPreload(entryKey{goenv: goenv, wd: sc})
+	}
+	return keyFor(goenv, wd, sc, arg, local)
 }
 
-func (c *Cache) getDir(key string) (string, bool) {
-	c.dirm.RLock()
-	defer c.dirm.RUnlock()
-	wd, _ := c.env.Getwd()
-	v, ok := c.dirCache[keyWithDir{key: wd, dir: key}]
-	return v, ok
+// keyFor returns the key for arg looked up from dir. Local args are relative
+// to dir, so are keyed by dir itself rather than by its scope.
+func keyFor(goenv, dir, scope, arg string, local bool) entryKey {
+	if local {
+		return entryKey{goenv: goenv, wd: dir, arg: arg}
+	}
+	return entryKey{goenv: goenv, wd: scope, arg: arg}
 }
 
-func (c *Cache) getDirs(key string) (map[string]string, bool) {
-	c.dirsm.RLock()
-	defer c.dirsm.RUnlock()
-	wd, _ := c.env.Getwd()
-	v, ok := c.dirsCache[keyWithDir{dir: wd, key: key}]
-	return v, ok
+// dirCheck is the result of the last check of a dir: the fingerprint of the
+// module configuration files governing it, its scope, and the environment and
+// time it was checked in.
+type dirCheck struct {
+	fp    fingerprint
+	scope string
+	goenv string
+	at    time.Time
 }
 
-func (c *Cache) getPath(key string) (string, bool) {
-	c.pathm.RLock()
-	defer c.pathm.RUnlock()
-	wd, _ := c.env.Getwd()
-	v, ok := c.pathCache[keyWithDir{dir: wd, key: key}]
-	return v, ok
+// check fingerprints the module configuration files governing dir, and if they
+// have changed since they were last fingerprinted for the scope of dir,
+// discards all entries cached for dir and its scope. Entries are shared by all
+// dirs in a scope, so the fingerprint is too, and a change seen from any dir
+// in the scope discards them. If the Cache has a Store, the entries stored for
+// dir are loaded. It returns the hash of the current Go environment and the
+// scope of dir.
+//
+// If dir was checked in the same environment less than the check interval ago
+// (see WithCheckInterval), the files are not checked again, and the scope found
+// then is returned.
+func (c *Cache) check(dir string) (goenv, sc string) {
+	goenv = envHash(c.env)
+	now := c.clock.Now()
+	c.modm.Lock()
+	var last dirCheck
+	v, seen, evicted := c.dirCache.get(entryKey{wd: dir})
+	if seen {
+		last = *v.(*dirCheck)
+	}
+	c.modm.Unlock()
+	if seen && last.goenv == goenv && c.checkInterval > 0 && now.Sub(last.at) < c.checkInterval {
+		if c.store != nil {
+			c.load(goenv, dir, last.scope, last.fp)
+		}
+		return goenv, last.scope
+	}
+
+	files := configFiles(c.env, dir)
+	// the stamps of the last check of dir are reused, so files are only
+	// hashed again when they have been written
+	next, changed := refresh(c.env, last.fp, files)
+	sc = scope(c.env, dir, next)
+	if c.checkInterval > 0 {
+		for _, fpath := range files {
+			if fpath != "" {
+				c.watchDir(filepath.Dir(fpath))
+			}
+		}
+	}
+
+	c.modm.Lock()
+	evicted = append(evicted, c.dirCache.set(entryKey{wd: dir}, &dirCheck{fp: next, scope: sc, goenv: goenv, at: now})...)
+	prev, ok, expired := c.modCache.get(entryKey{wd: sc})
+	evictedScopes := append(expired, c.modCache.set(entryKey{wd: sc}, next)...)
+	stale := map[string]bool{}
+	if ok && !sameFiles(prev.(fingerprint), next) {
+		stale[dir], stale[sc] = true, true
+	}
+	if seen && changed {
+		// entries relative to dir are only checked against the files seen
+		// by dir itself
+		stale[dir] = true
+	}
+	// entries keyed by an evicted dir or scope can no longer be checked, so
+	// they are discarded too. The dir of a scope is still checked against the
+	// fingerprint of the scope.
+	for _, item := range evicted {
+		if !c.modCache.has(item.key) {
+			stale[item.key.wd] = true
+		}
+	}
+	for _, item := range evictedScopes {
+		stale[item.key.wd] = true
+	}
+	if seen && last.scope != sc {
+		// the scope of dir has changed, e.g. because a go.mod was added, so
+		// entries for its old scope may be stale too
+		stale[dir], stale[sc], stale[last.scope] = true, true, true
+	}
+	for wd := range stale {
+		c.unpreload(wd)
+	}
+	c.modm.Unlock()
+	if len(stale) > 0 {
+		c.forget(filter{wd: func(wd string) bool { return stale[wd] }})
+	}
+	if c.store != nil {
+		c.load(goenv, dir, sc, next)
+	}
+	return goenv, sc
+}
+
+// recheck causes the module configuration files governing every dir to be
+// checked on the next lookup, regardless of the check interval.
+func (c *Cache) recheck() {
+	c.modm.Lock()
+	defer c.modm.Unlock()
+	c.dirCache.each(func(_ entryKey, v interface{}) {
+		v.(*dirCheck).at = time.Time{}
+	})
+}
+
+// load reads the store file for the environment and scope of dir into the
+// Cache, unless it has already been loaded.
+func (c *Cache) load(goenv, dir, sc string, fp fingerprint) {
+	key := storeKey(sc, fp, goenv)
+	c.storem.Lock()
+	c.storeKeys.set(entryKey{goenv: goenv, wd: dir}, key)
+	c.storeKeys.set(entryKey{goenv: goenv, wd: sc}, key)
+	_, loaded, _ := c.loaded.get(entryKey{arg: key})
+	c.loaded.set(entryKey{arg: key}, true)
+	c.storem.Unlock()
+	if loaded {
+		return
+	}
+	records, err := c.store.read(key)
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		// the store file is specific to the environment
+		r.Env = goenv
+		if c.current(r) {
+			c.apply(r)
+		}
+	}
+}
+
+// save adds the results of lookups to the Cache, and to the Store if the
+// Cache has one.
+func (c *Cache) save(records ...record) {
+	for _, r := range records {
+		c.apply(r)
+	}
+	c.persist(records)
+}
+
+// persist writes records to the Store, if the Cache has one. The records for
+// each store file are written together.
+func (c *Cache) persist(records []record) {
+	if c.store == nil {
+		return
+	}
+	saved := c.clock.Now().UnixNano()
+	var keys []string
+	byKey := map[string][]record{}
+	c.storem.Lock()
+	for _, r := range records {
+		v, ok, _ := c.storeKeys.get(entryKey{goenv: r.Env, wd: r.Wd})
+		if !ok {
+			continue
+		}
+		key := v.(string)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		r.Saved = saved
+		byKey[key] = append(byKey[key], r)
+	}
+	c.storem.Unlock()
+	for _, key := range keys {
+		_ = c.store.write(key, byKey[key])
+	}
 }
 
-func (c *Cache) getName(key keyWithDir) (string, bool) {
-	c.namem.RLock()
-	defer c.namem.RUnlock()
-	v, ok := c.nameCache[key]
+// apply adds a record to the cache maps. Dirs and Path results also add the
+// dir and path entries for each package they resolve. Records loaded from the
+// Store expire relative to when they were saved.
+func (c *Cache) apply(r record) {
+	key := func(arg string) entryKey {
+		return entryKey{goenv: r.Env, wd: r.Wd, arg: arg}
+	}
+	added := c.clock.Now()
+	if r.Saved != 0 {
+		added = time.Unix(0, r.Saved)
+	}
+	switch r.Method {
+	case DirMethod:
+		c.set(DirMethod, key(r.Key), r.Value, added)
+	case DirsMethod:
+		c.set(DirsMethod, key(r.Key), r.Dirs, added)
+		for ppath, dir := range r.Dirs {
+			c.set(DirMethod, key(ppath), dir, added)
+			c.set(PathMethod, key(dir), ppath, added)
+		}
+	case PathMethod:
+		c.set(PathMethod, key(r.Key), r.Value, added)
+		if r.Dir != "" {
+			c.set(DirMethod, key(r.Value), r.Dir, added)
+			c.set(PathMethod, key(r.Dir), r.Value, added)
+		}
+	case NameMethod:
+		c.set(NameMethod, key(r.Key), r.Value, added)
+	}
+}
+
+// current reports whether a record loaded from the Store may still be
+// current: it has not expired (see WithTTL), and the package dirs it resolves
+// still exist.
+func (c *Cache) current(r record) bool {
+	if c.ttl > 0 && (r.Saved == 0 || c.clock.Now().Sub(time.Unix(0, r.Saved)) >= c.ttl) {
+		return false
+	}
+	var dirs []string
+	switch r.Method {
+	case DirMethod:
+		dirs = append(dirs, r.Value)
+	case DirsMethod:
+		for _, dir := range r.Dirs {
+			dirs = append(dirs, dir)
+		}
+	case PathMethod:
+		dirs = append(dirs, r.Key, r.Dir)
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		if s, err := c.env.Stat(dir); err != nil || !s.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// filter selects entries to discard. Any of the funcs may be nil.
+type filter struct {
+	path      func(ppath string) bool // matches package paths
+	dir       func(dir string) bool   // matches package dirs
+	wd        func(wd string) bool    // matches working dirs
+	wildcards bool                    // matches all dirs entries for wildcard patterns, and all not found entries for package paths
+	store     bool                    // also discards the matched entries from the Store
+}
+
+// forget discards the entries selected by f. Once an entry matches, the
+// package path and dir it maps between are also discarded from the other maps
+// for the same working dir, so no stale mapping remains in either direction.
+// If f.store is set, the discarded entries are also removed from the Store.
+// Entries that were evicted from the Cache but are still in the Store are not
+// removed, but are only loaded again if their dirs still exist.
+func (c *Cache) forget(f filter) {
+	// the discarded entries, to remove from the Store
+	var removed []record
+	remove := func(method string, k entryKey) bool {
+		if f.store && c.store != nil {
+			removed = append(removed, record{Method: method, Env: k.goenv, Wd: k.wd, Key: k.arg, Deleted: true})
+		}
+		return true
+	}
+
+	// the package paths and dirs discarded so far, keyed by environment and
+	// working dir
+	paths := map[entryKey]bool{}
+	dirs := map[entryKey]bool{}
+	// name entries are keyed by src dir rather than working dir, so they
+	// are matched against the package paths discarded from any working dir
+	names := map[string]bool{}
+	matchPath := func(k entryKey, ppath string) bool {
+		return paths[entryKey{goenv: k.goenv, wd: k.wd, arg: ppath}] || (f.path != nil && f.path(ppath))
+	}
+	matchDir := func(k entryKey, dir string) bool {
+		return dirs[entryKey{goenv: k.goenv, wd: k.wd, arg: dir}] || (f.dir != nil && f.dir(dir))
+	}
+	matchWd := func(wd string) bool {
+		return f.wd != nil && f.wd(wd)
+	}
+
+	// dir and path entries are paired, so two passes are needed to discard
+	// the partner of every matched entry
+	for i := 0; i < 2; i++ {
+		c.table(DirMethod).filter(func(k entryKey, v interface{}) bool {
+			dir := v.(string)
+			if matchWd(k.wd) || matchPath(k, k.arg) || matchDir(k, dir) {
+				paths[k] = true
+				dirs[entryKey{goenv: k.goenv, wd: k.wd, arg: dir}] = true
+				names[k.arg] = true
+				return remove(DirMethod, k)
+			}
+			return false
+		})
+
+		c.table(PathMethod).filter(func(k entryKey, v interface{}) bool {
+			ppath := v.(string)
+			if matchWd(k.wd) || matchDir(k, k.arg) || matchPath(k, ppath) {
+				dirs[k] = true
+				paths[entryKey{goenv: k.goenv, wd: k.wd, arg: ppath}] = true
+				names[ppath] = true
+				return remove(PathMethod, k)
+			}
+			return false
+		})
+	}
+
+	c.table(DirsMethod).filter(func(k entryKey, v interface{}) bool {
+		if matchWd(k.wd) || matchPath(k, k.arg) || (f.wildcards && strings.Contains(k.arg, "...")) {
+			return remove(DirsMethod, k)
+		}
+		for ppath, dir := range v.(map[string]string) {
+			if matchPath(k, ppath) || matchDir(k, dir) {
+				return remove(DirsMethod, k)
+			}
+		}
+		return false
+	})
+
+	c.table(NameMethod).filter(func(k entryKey, v interface{}) bool {
+		if matchWd(k.wd) || names[k.arg] || (f.path != nil && f.path(k.arg)) || (f.dir != nil && f.dir(k.wd)) {
+			return remove(NameMethod, k)
+		}
+		return false
+	})
+
+	c.notFound[DirMethod].filter(func(k entryKey, v interface{}) bool {
+		return matchWd(k.wd) || matchPath(k, k.arg) || f.wildcards
+	})
+	c.notFound[PathMethod].filter(func(k entryKey, v interface{}) bool {
+		return matchWd(k.wd) || matchDir(k, k.arg)
+	})
+
+	if len(removed) > 0 {
+		c.persist(removed)
+	}
+}
+
+func (c *Cache) table(method string) *table {
+	return c.tables[method]
+}
+
+// get returns an entry. When an expired entry is evicted, the entry that maps
+// back to it is also evicted.
+func (c *Cache) get(method string, k entryKey) (interface{}, bool) {
+	v, ok, evicted := c.table(method).get(k)
+	switch method {
+	case DirMethod:
+		c.unpair(PathMethod, evicted)
+	case PathMethod:
+		c.unpair(DirMethod, evicted)
+	}
 	return v, ok
 }
 
-func (c *Cache) setDir(key, value string) {
-	c.dirm.Lock()
-	defer c.dirm.Unlock()
-	wd, _ := c.env.Getwd()
-	c.dirCache[keyWithDir{dir: wd, key: key}] = value
+// set adds an entry, which expires (see WithTTL) relative to added. Dir and
+// path entries are paired, so when one is evicted to make room the entry that
+// maps back to it is also evicted.
+func (c *Cache) set(method string, k entryKey, v interface{}, added time.Time) {
+	evicted := c.table(method).set(k, v, added)
+	switch method {
+	case DirMethod:
+		c.watchDir(v.(string))
+		c.unpair(PathMethod, evicted)
+	case PathMethod:
+		c.watchDir(k.arg)
+		c.unpair(DirMethod, evicted)
+	}
+}
+
+// unpair evicts the entries in the table for method that map back to the
+// evicted entries.
+func (c *Cache) unpair(method string, evicted []lruItem) {
+	for _, item := range evicted {
+		c.table(method).evict(entryKey{goenv: item.key.goenv, wd: item.key.wd, arg: item.value.(string)})
+	}
+}
+
+// table is one of the Cache's maps, guarded by its own lock.
+type table struct {
+	m   sync.Mutex
+	lru *lru
+}
+
+func newTable(max int, ttl time.Duration, clock Clock) *table {
+	return &table{lru: newLRU(max, ttl, clock)}
+}
+
+func (t *table) get(k entryKey) (interface{}, bool, []lruItem) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.lru.get(k)
+}
+
+func (t *table) set(k entryKey, v interface{}, added time.Time) []lruItem {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.lru.setAt(k, v, added)
+}
+
+func (t *table) evict(k entryKey) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lru.evict(k)
+}
+
+func (t *table) filter(fn func(k entryKey, v interface{}) bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lru.filter(fn)
 }
 
-func (c *Cache) setDirs(key string, value map[string]string) {
-	c.dirsm.Lock()
-	defer c.dirsm.Unlock()
-	wd, _ := c.env.Getwd()
-	c.dirsCache[keyWithDir{dir: wd, key: key}] = value
+func (t *table) each(fn func(k entryKey, v interface{})) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lru.each(fn)
 }
 
-func (c *Cache) setPath(key, value string) {
-	c.pathm.Lock()
-	defer c.pathm.Unlock()
-	wd, _ := c.env.Getwd()
-	c.pathCache[keyWithDir{dir: wd, key: key}] = value
+func (t *table) clear() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lru.clear()
 }
 
-func (c *Cache) setName(key keyWithDir, value string) {
-	c.namem.Lock()
-	defer c.namem.Unlock()
-	c.nameCache[key] = value
+func (t *table) evictions() int64 {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.lru.evictions
 }
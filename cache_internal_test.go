@@ -0,0 +1,298 @@
+package patsy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dave/patsy/vos"
+	"github.com/dave/patsy/vos/mock"
+	"github.com/pkg/errors"
+)
+
+// countingCache returns a Cache whose underlying lookups are counted and take
+// long enough for concurrent misses to overlap.
+func countingCache(t *testing.T, err error) (*Cache, *int32) {
+	env := vos.Mock()
+	if err := env.Setwd(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(env)
+	var count int32
+	c.dirs = func(env vos.Env, ppath string) (map[string]string, error) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(100 * time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{ppath: "/" + ppath}, nil
+	}
+	c.path = func(env vos.Env, dir string) (string, error) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(100 * time.Millisecond)
+		return dir[1:], err
+	}
+	c.name = func(env vos.Env, ppath, srcDir string) (string, error) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(100 * time.Millisecond)
+		return "a", err
+	}
+	return c, &count
+}
+
+// parallel calls fn from n goroutines at once, and returns the errors.
+func parallel(n int, fn func() error) []error {
+	var ready, done sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		ready.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			ready.Done()
+			<-start
+			errs[i] = fn()
+		}(i)
+	}
+	ready.Wait()
+	close(start)
+	done.Wait()
+	return errs
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	lookups := map[string]func(c *Cache) error{
+		"Dirs": func(c *Cache) error {
+			_, err := c.Dirs("ns/a")
+			return err
+		},
+		"Dir": func(c *Cache) error {
+			_, err := c.Dir("ns/a")
+			return err
+		},
+		"Path": func(c *Cache) error {
+			_, err := c.Path("/ns/a")
+			return err
+		},
+		"Name": func(c *Cache) error {
+			_, err := c.Name("ns/a", "/")
+			return err
+		},
+	}
+	for name, lookup := range lookups {
+		t.Run(name, func(t *testing.T) {
+			c, count := countingCache(t, nil)
+			for _, err := range parallel(100, func() error { return lookup(c) }) {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if *count != 1 {
+				t.Fatalf("Got %d lookups, expected 1", *count)
+			}
+		})
+		t.Run(name+" error", func(t *testing.T) {
+			expected := errors.New("lookup failed")
+			c, count := countingCache(t, expected)
+			for _, err := range parallel(100, func() error { return lookup(c) }) {
+				// Dir reports its own error when Dirs fails, as patsy.Dir does
+				if err == nil || (name != "Dir" && err != expected) {
+					t.Fatalf("Got %v, expected %v", err, expected)
+				}
+			}
+			if *count != 1 {
+				t.Fatalf("Got %d lookups, expected 1", *count)
+			}
+		})
+	}
+}
+
+func TestCacheEvictsPairs(t *testing.T) {
+	env := vos.Mock()
+	c := NewCache(env, WithMaxEntries(2))
+
+	for _, name := range []string{"a", "b", "c"} {
+		c.apply(record{Method: PathMethod, Wd: "/", Key: "/" + name, Value: name, Dir: "/" + name})
+	}
+	c.apply(record{Method: PathMethod, Wd: "/", Key: "/d", Value: "d", Dir: "/d"})
+
+	// the entries for "a" and "b" have been evicted from one map, so must also
+	// be gone from the other
+
+	for _, name := range []string{"a", "b"} {
+		if _, ok := c.table(PathMethod).lru.items[entryKey{wd: "/", arg: "/" + name}]; ok {
+			t.Fatalf("Expected path entry for %s to be evicted", name)
+		}
+		if _, ok := c.table(DirMethod).lru.items[entryKey{wd: "/", arg: name}]; ok {
+			t.Fatalf("Expected dir entry for %s to be evicted", name)
+		}
+	}
+	for _, name := range []string{"c", "d"} {
+		if _, ok := c.table(PathMethod).lru.items[entryKey{wd: "/", arg: "/" + name}]; !ok {
+			t.Fatalf("Expected path entry for %s", name)
+		}
+		if _, ok := c.table(DirMethod).lru.items[entryKey{wd: "/", arg: name}]; !ok {
+			t.Fatalf("Expected dir entry for %s", name)
+		}
+	}
+}
+
+func TestCacheBoundsWorkingDirs(t *testing.T) {
+	fs := mock.NewFS()
+	var wds []string
+	for i := 0; i < 500; i++ {
+		wd := fmt.Sprintf("/m%d", i)
+		if err := fs.MkdirAll(wd); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.WriteFile(wd+"/go.mod", []byte("module ns")); err != nil {
+			t.Fatal(err)
+		}
+		wds = append(wds, wd)
+	}
+	env := vos.MockFS(fs)
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(env, WithMaxEntries(2), WithStore(store), WithPreload())
+	c.dirs = func(env vos.Env, ppath string) (map[string]string, error) {
+		wd, _ := env.Getwd()
+		return map[string]string{ppath: wd + "/a"}, nil
+	}
+	for _, wd := range wds {
+		if err := env.Setwd(wd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Dirs("ns/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.modm.Lock()
+	sizes := map[string]int{"dirCache": len(c.dirCache.items), "modCache": len(c.modCache.items), "preloaded": len(c.preloaded.items)}
+	c.modm.Unlock()
+	c.storem.Lock()
+	sizes["storeKeys"], sizes["loaded"] = len(c.storeKeys.items), len(c.loaded.items)
+	c.storem.Unlock()
+	for name, size := range sizes {
+		if size > 2 {
+			t.Fatalf("Got %d entries in %s, expected at most 2", size, name)
+		}
+	}
+
+	// entries are only kept while the files governing their working dir are
+	// fingerprinted
+	c.table(DirsMethod).each(func(k entryKey, v interface{}) {
+		if !c.modCache.has(entryKey{wd: k.wd}) {
+			t.Fatalf("Got an entry for %s, expected it to be discarded with its fingerprint", k.wd)
+		}
+	})
+}
+
+func TestFingerprintMockFS(t *testing.T) {
+	t.Parallel()
+	fs := mock.NewFS()
+	for _, dir := range []string{"/m/a/b", "/m/vendor", "/gopath/src/ns/v/vendor", "/gopath/src/ns/v/x"} {
+		if err := fs.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/m/go.mod", []byte("module m")); err != nil {
+		t.Fatal(err)
+	}
+	env := vos.MockFS(fs)
+	env.Setenv("GOPATH", "/gopath")
+	env.Setenv("GOWORK", "")
+
+	files := configFiles(env, "/m/a/b")
+	if files[goModFile] != "/m/go.mod" || files[modulesTxtFile] != "/m/vendor/modules.txt" || files[goWorkFile] != "" {
+		t.Fatalf("unexpected config files %v", files)
+	}
+	fp, changed := refresh(env, fingerprint{}, files)
+	if !changed || fp[goModFile].path != "/m/go.mod" || fp[goSumFile].path != "" {
+		t.Fatalf("unexpected fingerprint %v", fp)
+	}
+	if sc := scope(env, "/m/a/b", fp); sc != "/m" {
+		t.Fatalf("got scope %s, expected /m", sc)
+	}
+
+	// only the modification time changes, so the fingerprint is the same
+	if err := fs.Chtimes("/m/go.mod", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed := refresh(env, fp, files); changed {
+		t.Fatal("expected unchanged fingerprint")
+	}
+	if err := fs.WriteFile("/m/go.mod", []byte("module n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed := refresh(env, fp, files); !changed {
+		t.Fatal("expected changed fingerprint")
+	}
+
+	env.Setenv("GO111MODULE", "off")
+	for dir, expected := range map[string]string{
+		"/gopath/src/ns/v/x": "/gopath/src/ns/v",
+		"/gopath/src/ns":     "/gopath/src",
+		"/gopath/src/ns/y":   "/gopath/src/ns/y",
+	} {
+		if sc := scope(env, dir, fingerprint{}); sc != expected {
+			t.Fatalf("got scope %s for %s, expected %s", sc, dir, expected)
+		}
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := func(key, value string) record {
+		return record{Method: DirMethod, Wd: "/m", Key: key, Value: value}
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.write("k", []record{r("a", fmt.Sprint(i)), r("b", "b"), r("c", "c")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := r("c", "")
+	deleted.Deleted = true
+	if err := s.write("k", []record{deleted}); err != nil {
+		t.Fatal(err)
+	}
+	// an interrupted write leaves a partial record
+	f, err := os.OpenFile(s.path("k"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"method":"Dir","wd":"/m","ke`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []record{r("a", "2"), r("b", "b")}
+	records, err := s.read("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Got %+v, expected %+v", records, expected)
+	}
+
+	// the replaced, deleted and corrupt records have been removed
+	records, stale, err := s.readLocked("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 || !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Got %+v with %d stale, expected %+v with none", records, stale, expected)
+	}
+}
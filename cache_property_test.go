@@ -0,0 +1,137 @@
+package patsy_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dave/patsy"
+	"github.com/dave/patsy/builder"
+	"github.com/dave/patsy/vos"
+)
+
+// TestCacheProperty runs random sequences of lookups against a Cache, and
+// checks the results are always the same as the uncached functions.
+func TestCacheProperty(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		for seed := int64(1); seed <= 3; seed++ {
+			t.Run(fmt.Sprintf("gomod=%v,seed=%d", gomod, seed), func(t *testing.T) {
+				testCacheProperty(t, gomod, seed, 60)
+			})
+		}
+	}
+}
+
+func testCacheProperty(t *testing.T, gomod bool, seed int64, steps int) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packages := map[string]map[string]string{
+		"a":   {"a.go": "package a"},
+		"a/b": {"b.go": "package b"},
+		"c":   {"c.go": "package c"},
+		"d":   nil,
+		"e":   {"e.go": "package x"},
+	}
+	if !gomod {
+		// a vendored version of "c" inside "a" with a different name
+		packages["a/vendor/ns/c"] = map[string]string{"c.go": "package v"}
+	}
+
+	root := b.Root()
+	dirs := []string{root, filepath.Join(root, "missing")}
+	files := []string{filepath.Join(root, "missing", "m.go")}
+	for name, contents := range packages {
+		_, dir, err := b.Package(name, contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir, dir+string(filepath.Separator))
+		for fname := range contents {
+			files = append(files, filepath.Join(dir, fname))
+		}
+	}
+	ppaths := []string{"ns/a", "ns/a/b", "ns/c", "ns/d", "ns/e", "ns/missing", ".", "./...", "ns/...", "ns/a/..."}
+	gpaths := []string{"ns/a/a.go", "ns/c/c.go", "ns/d/d.go", "ns/e/e.go", "ns/missing/m.go"}
+	wds := []string{root, filepath.Join(root, "a"), filepath.Join(root, "a", "b"), filepath.Join(root, "c")}
+
+	c := patsy.NewCache(env)
+	r := rand.New(rand.NewSource(seed))
+	pick := func(from []string) string {
+		return from[r.Intn(len(from))]
+	}
+
+	for i := 0; i < steps; i++ {
+		var desc string
+		var cached, uncached interface{}
+		var cachedErr, uncachedErr error
+		switch r.Intn(10) {
+		case 0:
+			wd := pick(wds)
+			desc = fmt.Sprintf("Setwd(%s)", wd)
+			if err := env.Setwd(wd); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		case 1:
+			ppath := pick(ppaths)
+			desc = fmt.Sprintf("Dir(%s)", ppath)
+			cached, cachedErr = c.Dir(ppath)
+			uncached, uncachedErr = patsy.Dir(env, ppath)
+		case 2:
+			ppath := pick(ppaths)
+			desc = fmt.Sprintf("Dirs(%s)", ppath)
+			cached, cachedErr = c.Dirs(ppath)
+			uncached, uncachedErr = patsy.Dirs(env, ppath)
+		case 3:
+			dir := pick(dirs)
+			desc = fmt.Sprintf("Path(%s)", dir)
+			cached, cachedErr = c.Path(dir)
+			uncached, uncachedErr = patsy.Path(env, dir)
+		case 4:
+			ppath, srcDir := pick(ppaths), pick(dirs)
+			desc = fmt.Sprintf("Name(%s, %s)", ppath, srcDir)
+			cached, cachedErr = c.Name(ppath, srcDir)
+			uncached, uncachedErr = patsy.Name(env, ppath, srcDir)
+		case 5:
+			fpath := pick(files)
+			desc = fmt.Sprintf("GoName(%s)", fpath)
+			cached, cachedErr = c.GoName(fpath)
+			uncached, uncachedErr = patsy.GoName(env, fpath)
+		case 6:
+			gpath := pick(gpaths)
+			desc = fmt.Sprintf("FilePath(%s)", gpath)
+			cached, cachedErr = c.FilePath(gpath)
+			uncached, uncachedErr = patsy.FilePath(env, gpath)
+		case 7:
+			batch := []string{pick(files), pick(files), pick(files)}
+			desc = fmt.Sprintf("GoNames(%v)", batch)
+			cached, cachedErr = c.GoNames(batch)
+			uncached, uncachedErr = patsy.GoNames(env, batch)
+		case 8:
+			batch := []string{pick(gpaths), pick(gpaths), pick(gpaths)}
+			desc = fmt.Sprintf("FilePaths(%v)", batch)
+			cached, cachedErr = c.FilePaths(batch)
+			uncached, uncachedErr = patsy.FilePaths(env, batch)
+		case 9:
+			desc = "Preload()"
+			if err := c.Preload(context.Background()); err != nil {
+				t.Fatalf("Step %d %s: %v", i, desc, err)
+			}
+			continue
+		}
+		if (cachedErr == nil) != (uncachedErr == nil) {
+			t.Fatalf("Step %d %s: got error %v, expected error %v", i, desc, cachedErr, uncachedErr)
+		}
+		if cachedErr == nil && !reflect.DeepEqual(cached, uncached) {
+			t.Fatalf("Step %d %s: got %v, expected %v", i, desc, cached, uncached)
+		}
+	}
+}
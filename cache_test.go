@@ -0,0 +1,1269 @@
+package patsy_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dave/patsy"
+	"github.com/dave/patsy/builder"
+	"github.com/dave/patsy/vos"
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/mock"
+	"github.com/pkg/errors"
+)
+
+func TestCacheGoModChanged(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check the go.mod on every lookup, so the change is seen immediately
+	c := patsy.NewCache(env, patsy.WithCheckInterval(0))
+
+	calculatedPath, err := c.Path(packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedPath != packagePath {
+		t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+	}
+
+	// rename the module, so the cached package path is now stale
+	if err := b.File("", "go.mod", "module ns2"); err != nil {
+		t.Fatal(err)
+	}
+
+	calculatedPath, err = c.Path(packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "ns2/a"
+	if calculatedPath != expected {
+		t.Fatalf("Got %s, expected %s", calculatedPath, expected)
+	}
+
+	calculatedDir, err := c.Dir(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir != packageDir {
+		t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+	}
+}
+
+func TestCacheGoModChangedSubdir(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.Setwd(b.Root()); err != nil {
+		t.Fatal(err)
+	}
+	c := patsy.NewCache(env)
+	calculatedPath, err := c.Path(packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedPath != packagePath {
+		t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+	}
+
+	// the change is first seen from a dir that hasn't been used before, but
+	// shares the entries cached from the module root
+	if err := b.File("", "go.mod", "module ns2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setwd(packageDir); err != nil {
+		t.Fatal(err)
+	}
+	calculatedPath, err = c.Path(packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ns2/a"; calculatedPath != expected {
+		t.Fatalf("Got %s, expected %s", calculatedPath, expected)
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		t.Run(fmt.Sprintf("poll=%v", poll), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePath, packageDir, err := b.Package("a", map[string]string{
+				"a.go": "package a",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := patsy.NewCache(env)
+
+			if _, err := c.Path(packageDir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Dir(packagePath); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events := make(chan patsy.Event, 100)
+			defer c.Subscribe(func(e patsy.Event) { events <- e })()
+
+			if poll {
+				err = c.Poll(ctx, 10*time.Millisecond)
+			} else {
+				err = c.Watch(ctx)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Rename(packageDir, packageDir+"-moved"); err != nil {
+				t.Fatal(err)
+			}
+
+			timeout := time.After(5 * time.Second)
+		Wait:
+			for {
+				select {
+				case e := <-events:
+					if e.Dir == packageDir && e.Op != patsy.Changed {
+						break Wait
+					}
+				case <-timeout:
+					t.Fatal("Timed out waiting for event")
+				}
+			}
+
+			if _, err := c.Dir(packagePath); !patsy.IsNotFound(err) {
+				t.Fatalf("Got %v, expected not found", err)
+			}
+
+			if _, err := c.Path(packageDir); err == nil {
+				t.Fatal("Expected error, got none.")
+			}
+		})
+	}
+}
+
+func TestCacheForget(t *testing.T) {
+	type forgetFunc func(c *patsy.Cache, env vos.Env, packagePath, packageDir string)
+	tests := map[string]struct {
+		forget forgetFunc
+		keepsB bool
+	}{
+		"Forget": {
+			forget: func(c *patsy.Cache, env vos.Env, packagePath, packageDir string) { c.Forget(packagePath) },
+			keepsB: true,
+		},
+		"ForgetDir": {
+			forget: func(c *patsy.Cache, env vos.Env, packagePath, packageDir string) { c.ForgetDir(packageDir) },
+			keepsB: true,
+		},
+		"ForgetPrefix": {
+			forget: func(c *patsy.Cache, env vos.Env, packagePath, packageDir string) { c.ForgetPrefix("ns") },
+			keepsB: false,
+		},
+		"ForgetWorkingDir": {
+			forget: func(c *patsy.Cache, env vos.Env, packagePath, packageDir string) {
+				wd, _ := env.Getwd()
+				c.ForgetWorkingDir(wd)
+			},
+			keepsB: false,
+		},
+		"Reset": {
+			forget: func(c *patsy.Cache, env vos.Env, packagePath, packageDir string) { c.Reset() },
+			keepsB: false,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePathA, packageDirA, err := b.Package("a", map[string]string{
+				"a.go": "package a",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			packagePathB, packageDirB, err := b.Package("b", map[string]string{
+				"b.go": "package b",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := patsy.NewCache(env)
+
+			for _, packageDir := range []string{packageDirA, packageDirB} {
+				if _, err := c.Path(packageDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, packagePath := range []string{packagePathA, packagePathB} {
+				if _, err := c.Dir(packagePath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// delete the packages so that only cached entries can resolve them
+			for _, packageDir := range []string{packageDirA, packageDirB} {
+				if err := os.RemoveAll(packageDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			test.forget(c, env, packagePathA, packageDirA)
+
+			// neither direction of the mapping for "a" should remain
+			if _, err := c.Dir(packagePathA); err == nil {
+				t.Fatalf("Expected error for Dir(%s), got none.", packagePathA)
+			}
+			if _, err := c.Path(packageDirA); err == nil {
+				t.Fatalf("Expected error for Path(%s), got none.", packageDirA)
+			}
+
+			_, errDir := c.Dir(packagePathB)
+			_, errPath := c.Path(packageDirB)
+			if test.keepsB {
+				if errDir != nil {
+					t.Fatalf("Expected Dir(%s) to be cached, got '%s'", packagePathB, errDir)
+				}
+				if errPath != nil {
+					t.Fatalf("Expected Path(%s) to be cached, got '%s'", packageDirB, errPath)
+				}
+			} else {
+				if errDir == nil {
+					t.Fatalf("Expected error for Dir(%s), got none.", packagePathB)
+				}
+				if errPath == nil {
+					t.Fatalf("Expected error for Path(%s), got none.", packageDirB)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	storeDir, err := ioutil.TempDir("", "patsy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	store, err := patsy.NewStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expectStored looks up the package with a new Cache, and checks whether
+	// it was loaded from the store
+	expectStored := func(stored bool, options ...patsy.Option) {
+		t.Helper()
+		c := patsy.NewCache(env, append(options, patsy.WithStore(store))...)
+		calculatedDir, err := c.Dir(packagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedDir != packageDir {
+			t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+		}
+		if commands := c.Stats().Dirs.Commands; (commands == 0) != stored {
+			t.Fatalf("Got %d commands, expected stored=%v", commands, stored)
+		}
+	}
+
+	expectStored(false)
+	expectStored(true)
+
+	// forgetting the package removes it from the store
+	c := patsy.NewCache(env, patsy.WithStore(store))
+	if _, err := c.Dir(packagePath); err != nil {
+		t.Fatal(err)
+	}
+	c.Forget(packagePath)
+	expectStored(false)
+
+	// stored results expire
+	clock := &testClock{now: time.Now().Add(time.Hour)}
+	expectStored(true, patsy.WithTTL(2*time.Hour), patsy.WithClock(clock))
+	expectStored(false, patsy.WithTTL(time.Hour), patsy.WithClock(clock))
+
+	// changing go.mod invalidates the stored results
+	if err := b.File("", "go.mod", "module ns\n\ngo 1.12\n\n// changed\n"); err != nil {
+		t.Fatal(err)
+	}
+	expectStored(false)
+	expectStored(true)
+
+	// stored results for deleted packages are discarded
+	if err := os.RemoveAll(packageDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := patsy.NewCache(env, patsy.WithStore(store)).Dir(packagePath); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+}
+
+func TestCacheStoreConcurrent(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	storeDir, err := ioutil.TempDir("", "patsy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	store, err := patsy.NewStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packageDirs := map[string]string{}
+	for i := 0; i < 10; i++ {
+		packagePath, packageDir, err := b.Package(fmt.Sprintf("p%d", i), map[string]string{
+			"p.go": fmt.Sprintf("package p%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packageDirs[packagePath] = packageDir
+	}
+
+	// each cache has its own store file handle, like separate processes
+	var wg sync.WaitGroup
+	errs := make(chan error, len(packageDirs))
+	for packagePath := range packageDirs {
+		wg.Add(1)
+		go func(packagePath string) {
+			defer wg.Done()
+			if _, err := patsy.NewCache(env, patsy.WithStore(store)).Dir(packagePath); err != nil {
+				errs <- err
+			}
+		}(packagePath)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// no result should have been lost
+	c := patsy.NewCache(env, patsy.WithStore(store))
+	for packagePath, packageDir := range packageDirs {
+		calculatedDir, err := c.Dir(packagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedDir != packageDir {
+			t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+		}
+	}
+	if stats := c.Stats(); stats.Dirs.Commands != 0 {
+		t.Fatalf("Got %+v, expected all lookups to be loaded from the store", stats)
+	}
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestCacheTTL(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := patsy.NewCache(env, patsy.WithTTL(time.Minute), patsy.WithClock(clock))
+
+	if _, err := c.Dir(packagePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Path(packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// delete the package so that only cached entries can resolve it
+	if err := os.RemoveAll(packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = clock.now.Add(59 * time.Second)
+	if _, err := c.Dir(packagePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Path(packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if _, err := c.Dir(packagePath); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	if _, err := c.Path(packageDir); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+}
+
+func TestCacheCheckInterval(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	_, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := patsy.NewCache(env, patsy.WithCheckInterval(time.Minute), patsy.WithClock(clock))
+	expectPath := func(expected string) {
+		t.Helper()
+		calculatedPath, err := c.Path(packageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedPath != expected {
+			t.Fatalf("Got %s, expected %s", calculatedPath, expected)
+		}
+	}
+	expectPath("ns/a")
+
+	// the change isn't seen until the interval has passed
+	if err := b.File("", "go.mod", "module ns2"); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(59 * time.Second)
+	expectPath("ns/a")
+	clock.now = clock.now.Add(time.Second)
+	expectPath("ns2/a")
+
+	if runtime.GOOS != "linux" {
+		// polling can't see files written in place
+		return
+	}
+
+	// while watching, a change event causes the files to be checked again
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan patsy.Event, 100)
+	defer c.Subscribe(func(e patsy.Event) { events <- e })()
+	if err := c.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	expectPath("ns2/a")
+
+	if err := b.File("", "go.mod", "module ns3"); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+Wait:
+	for {
+		select {
+		case e := <-events:
+			if e.Dir == b.Root() {
+				break Wait
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+	expectPath("ns3/a")
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	var packagePaths, packageDirs []string
+	for _, name := range []string{"a", "b", "c"} {
+		packagePath, packageDir, err := b.Package(name, map[string]string{
+			name + ".go": "package " + name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packagePaths = append(packagePaths, packagePath)
+		packageDirs = append(packageDirs, packageDir)
+	}
+
+	c := patsy.NewCache(env, patsy.WithMaxEntries(2))
+
+	for i := range packagePaths {
+		if _, err := c.Dir(packagePaths[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Path(packageDirs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// delete the packages so that only cached entries can resolve them
+	for _, packageDir := range packageDirs {
+		if err := os.RemoveAll(packageDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "a" is the least recently used so it has been evicted
+	if _, err := c.Dir(packagePaths[0]); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	if _, err := c.Path(packageDirs[0]); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	for i := 1; i < len(packagePaths); i++ {
+		if _, err := c.Dir(packagePaths[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Path(packageDirs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type testObserver struct {
+	m        sync.Mutex
+	lookups  []patsy.LookupEvent
+	commands []patsy.CommandEvent
+}
+
+func (o *testObserver) Lookup(e patsy.LookupEvent) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.lookups = append(o.lookups, e)
+}
+
+func (o *testObserver) Command(e patsy.CommandEvent) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.commands = append(o.commands, e)
+}
+
+func TestCacheStats(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePathA, _, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packagePathB, _, err := b.Package("b", map[string]string{
+		"b.go": "package b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &testObserver{}
+	c := patsy.NewCache(env, patsy.WithObserver(o), patsy.WithMaxEntries(1))
+
+	for _, packagePath := range []string{packagePathA, packagePathA, packagePathB} {
+		if _, err := c.Dirs(packagePath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := c.Stats().Dirs
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Commands != 2 || stats.Evictions != 1 || stats.InFlight != 0 {
+		t.Fatalf("Got %+v, expected 1 hit, 2 misses, 2 commands and 1 eviction", stats)
+	}
+	if stats.Time <= 0 {
+		t.Fatalf("Got %v, expected positive command time", stats.Time)
+	}
+
+	expected := []patsy.LookupEvent{
+		{Method: patsy.DirsMethod, Wd: b.Root(), Key: packagePathA, Hit: false},
+		{Method: patsy.DirsMethod, Wd: b.Root(), Key: packagePathA, Hit: true},
+		{Method: patsy.DirsMethod, Wd: b.Root(), Key: packagePathB, Hit: false},
+	}
+	if fmt.Sprint(o.lookups) != fmt.Sprint(expected) {
+		t.Fatalf("Got %v, expected %v", o.lookups, expected)
+	}
+	if len(o.commands) != 2 || o.commands[0].Key != packagePathA || o.commands[1].Key != packagePathB {
+		t.Fatalf("Got %v, expected commands for %s and %s", o.commands, packagePathA, packagePathB)
+	}
+}
+
+func TestCacheGoEnvStats(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	o := &testObserver{}
+	c := patsy.NewCache(env, patsy.WithObserver(o))
+
+	// the GOPATH fallbacks of missing packages run go env once for the
+	// environment
+	for _, packagePath := range []string{"ns/missing", "ns/other"} {
+		if _, err := c.Dir(packagePath); !patsy.IsNotFound(err) {
+			t.Fatalf("Got %v, expected not found", err)
+		}
+	}
+	if stats := c.Stats().GoEnv; stats.Commands != 1 || stats.InFlight != 0 {
+		t.Fatalf("Got %+v, expected 1 command", stats)
+	}
+	var reported []patsy.CommandEvent
+	for _, e := range o.commands {
+		if e.Method == patsy.GoEnvMethod {
+			reported = append(reported, e)
+		}
+	}
+	if len(reported) != 1 || reported[0].Wd != b.Root() || reported[0].Key != "" {
+		t.Fatalf("Got %v, expected a go env command in %s", reported, b.Root())
+	}
+}
+
+func TestCachePreload(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packages := map[string]string{"a": "package a", "a/b": "package b", "c": "package x"}
+			dirs := map[string]string{}
+			for name, contents := range packages {
+				packagePath, packageDir, err := b.Package(name, map[string]string{"f.go": contents})
+				if err != nil {
+					t.Fatal(err)
+				}
+				dirs[packagePath] = packageDir
+			}
+
+			wd, err := env.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := patsy.NewCache(env)
+			if err := c.Preload(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			for packagePath, packageDir := range dirs {
+				calculatedDir, err := c.Dir(packagePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if calculatedDir != packageDir {
+					t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+				}
+				calculatedPath, err := c.Path(packageDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if calculatedPath != packagePath {
+					t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+				}
+				// names are preloaded for the working dir as the src dir
+				calculatedName, err := c.Name(packagePath, wd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectedName, err := patsy.Name(env, packagePath, wd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if calculatedName != expectedName {
+					t.Fatalf("Got %s, expected %s", calculatedName, expectedName)
+				}
+			}
+
+			stats := c.Stats()
+			if commands := stats.Dir.Commands + stats.Dirs.Commands + stats.Path.Commands + stats.Name.Commands; commands != 0 {
+				t.Fatalf("Got %d commands, expected all lookups to be preloaded", commands)
+			}
+			if stats.Preload.Commands != 1 {
+				t.Fatalf("Got %d preload commands, expected 1", stats.Preload.Commands)
+			}
+		})
+	}
+}
+
+// preloadObserver signals when a preload completes.
+type preloadObserver struct {
+	done chan error
+}
+
+func (o *preloadObserver) Lookup(patsy.LookupEvent) {}
+
+func (o *preloadObserver) Command(e patsy.CommandEvent) {
+	if e.Method == patsy.PreloadMethod {
+		o.done <- e.Err
+	}
+}
+
+func TestCacheWithPreload(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePathA, _, err := b.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packagePathB, packageDirB, err := b.Package("b", map[string]string{"b.go": "package b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &preloadObserver{done: make(chan error, 1)}
+	c := patsy.NewCache(env, patsy.WithObserver(o), patsy.WithPreload())
+
+	// the first lookup starts the preload, and is served while it runs
+	if _, err := c.Dir(packagePathA); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-o.done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("Timed out waiting for preload")
+	}
+
+	calculatedDir, err := c.Dir(packagePathB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir != packageDirB {
+		t.Fatalf("Got %s, expected %s", calculatedDir, packageDirB)
+	}
+	if hits := c.Stats().Dir.Hits; hits != 1 {
+		t.Fatalf("Got %d hits, expected the preloaded package to be a hit", hits)
+	}
+
+	// the preload only runs once per working dir
+	if _, err := c.Dir(packagePathA); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-o.done:
+		t.Fatal("Expected a single preload")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := patsy.NewCache(env)
+	if _, err := c.Dir(packagePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Name(packagePath, b.Root()); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delete the package so that only the snapshot can resolve it
+	if err := os.RemoveAll(packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := patsy.LoadCache(env, strings.NewReader(string(snapshot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calculatedDir, err := loaded.Dir(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir != packageDir {
+		t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+	}
+	calculatedPath, err := loaded.Path(packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedPath != packagePath {
+		t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+	}
+	calculatedName, err := loaded.Name(packagePath, b.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedName != "a" {
+		t.Fatalf("Got %s, expected a", calculatedName)
+	}
+
+	// entries are discarded when the module configuration no longer matches
+	if err := b.File("", "go.mod", "module ns\n\nrequire foo v1.0.0\n"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = patsy.LoadCache(env, strings.NewReader(string(snapshot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Dir(packagePath); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+
+	// and when the environment has changed
+	if err := b.File("", "go.mod", "module ns\n\ngo 1.12\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("GOFLAGS", "-tags=patsy"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = patsy.LoadCache(env, strings.NewReader(string(snapshot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Dir(packagePath); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+
+	if _, err := patsy.LoadCache(env, strings.NewReader("not json")); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+}
+
+func TestCacheSnapshotSubdir(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherDir, err := b.Package("b", map[string]string{
+		"b.go": "package b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the Cache is only used from package dirs, never from the module root
+	if err := env.Setwd(otherDir); err != nil {
+		t.Fatal(err)
+	}
+	c := patsy.NewCache(env)
+	if _, err := c.Dir(packagePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Name(packagePath, otherDir); err != nil {
+		t.Fatal(err)
+	}
+	// relative lookups are keyed by the working dir rather than its scope
+	if _, err := c.Dirs("."); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delete the package so that only the snapshot can resolve it
+	if err := os.RemoveAll(packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := patsy.LoadCache(env, strings.NewReader(string(snapshot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calculatedDir, err := loaded.Dir(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir != packageDir {
+		t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+	}
+	calculatedName, err := loaded.Name(packagePath, otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedName != "a" {
+		t.Fatalf("Got %s, expected a", calculatedName)
+	}
+	if _, err := loaded.Dirs("."); err != nil {
+		t.Fatal(err)
+	}
+	if stats := loaded.Stats(); stats.Dirs.Commands != 0 || stats.Name.Commands != 0 {
+		t.Fatalf("Got %+v, expected all lookups to be restored from the snapshot", stats)
+	}
+}
+
+func TestCacheEnvChanged(t *testing.T) {
+	env := vos.Mock()
+
+	// the same package path in a go module and a gopath
+	modBuilder, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer modBuilder.Cleanup()
+	packagePath, modDir, err := modBuilder.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathBuilder, err := builder.New(env, "ns", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pathBuilder.Cleanup()
+	_, pathDir, err := pathBuilder.Package("a", map[string]string{"a.go": "package b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath := env.Getenv("GOPATH")
+
+	if err := env.Setwd(modBuilder.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	setModules := func(on bool) {
+		t.Helper()
+		vars := map[string]string{"GO111MODULE": "on", "GOPATH": ""}
+		if !on {
+			vars = map[string]string{"GO111MODULE": "off", "GOPATH": gopath}
+		}
+		for name, value := range vars {
+			if err := env.Setenv(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := patsy.NewCache(env)
+	for _, on := range []bool{true, false, true, false} {
+		setModules(on)
+		expectedDir, expectedName := modDir, "a"
+		if !on {
+			expectedDir, expectedName = pathDir, "b"
+		}
+		calculatedDir, err := c.Dir(packagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedDir != expectedDir {
+			t.Fatalf("GO111MODULE=%v: got %s, expected %s", on, calculatedDir, expectedDir)
+		}
+		calculatedPath, err := c.Path(expectedDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedPath != packagePath {
+			t.Fatalf("GO111MODULE=%v: got %s, expected %s", on, calculatedPath, packagePath)
+		}
+		calculatedName, err := c.Name(packagePath, modBuilder.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedName != expectedName {
+			t.Fatalf("GO111MODULE=%v: got %s, expected %s", on, calculatedName, expectedName)
+		}
+	}
+
+	// the go tool only runs once in each environment
+	if stats := c.Stats(); stats.Dirs.Commands != 2 || stats.Path.Commands != 0 || stats.Name.Commands != 2 {
+		t.Fatalf("Got %+v, expected one Dirs and one Name command in each environment", stats)
+	}
+}
+
+func TestCacheGoEnvFile(t *testing.T) {
+	env := vos.Mock()
+
+	// the same package path in a go module and a gopath
+	modBuilder, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer modBuilder.Cleanup()
+	packagePath, modDir, err := modBuilder.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathBuilder, err := builder.New(env, "ns", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pathBuilder.Cleanup()
+	_, pathDir, err := pathBuilder.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setwd(modBuilder.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	// modules are turned off in the go env config file, as `go env -w` does
+	file := filepath.Join(t.TempDir(), "env")
+	if err := ioutil.WriteFile(file, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("GOENV", file); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Unsetenv("GO111MODULE"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := patsy.NewCache(env)
+	if calculatedDir, err := c.Dir(packagePath); err != nil || calculatedDir != modDir {
+		t.Fatalf("Got %s, %v, expected %s", calculatedDir, err, modDir)
+	}
+	if err := ioutil.WriteFile(file, []byte("GO111MODULE=off\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir, err := c.Dir(packagePath); err != nil || calculatedDir != pathDir {
+		t.Fatalf("Got %s, %v, expected %s", calculatedDir, err, pathDir)
+	}
+}
+
+func TestCacheScope(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePathA, packageDirA, err := b.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, packageDirB, err := b.Package("b", map[string]string{"b.go": "package b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := patsy.NewCache(env)
+	for _, wd := range []string{packageDirA, packageDirB} {
+		if err := env.Setwd(wd); err != nil {
+			t.Fatal(err)
+		}
+		calculatedDir, err := c.Dir(packagePathA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedDir != packageDirA {
+			t.Fatalf("Got %s, expected %s", calculatedDir, packageDirA)
+		}
+		// relative patterns are resolved from each working dir
+		dirs, err := c.Dirs(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dirs) != 1 {
+			t.Fatalf("Got %v, expected a single package", dirs)
+		}
+		for _, dir := range dirs {
+			if dir != wd {
+				t.Fatalf("Got %s, expected %s", dir, wd)
+			}
+		}
+	}
+
+	// working dirs in the same module share entries, apart from relative ones
+	if stats := c.Stats(); stats.Dir.Hits != 1 || stats.Dirs.Commands != 3 {
+		t.Fatalf("Got %+v, expected 1 Dir hit and 3 Dirs commands", stats)
+	}
+}
+
+func TestCacheNotFound(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	_, emptyDir, err := b.Package("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{now: time.Now()}
+	c := patsy.NewCache(env, patsy.WithNotFoundTTL(time.Minute), patsy.WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Dir("ns/b")
+		if !patsy.IsNotFound(err) {
+			t.Fatalf("Got %v, expected not found error", err)
+		}
+		if err.Error() != "Dir not found for ns/b" {
+			t.Fatalf("Got %q, expected %q", err.Error(), "Dir not found for ns/b")
+		}
+		if _, err := c.Path(emptyDir); !patsy.IsNotFound(err) {
+			t.Fatalf("Got %v, expected not found error", err)
+		}
+	}
+	if stats := c.Stats(); stats.Dir.Hits != 1 || stats.Path.Hits != 1 || stats.Dirs.Commands != 1 || stats.Path.Commands != 1 {
+		t.Fatalf("Got %+v, expected the second lookups to be hits", stats)
+	}
+
+	// the errors are cached until they expire or are forgotten
+	packagePath, packageDir, err := b.Package("b", map[string]string{"b.go": "package b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.File("a", "a.go", "package a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Dir(packagePath); !patsy.IsNotFound(err) {
+		t.Fatalf("Got %v, expected cached not found error", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	calculatedDir, err := c.Dir(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedDir != packageDir {
+		t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+	}
+	c.ForgetDir(emptyDir)
+	if _, err := c.Path(emptyDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default errors are not cached
+	c = patsy.NewCache(env)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Dir("ns/c"); !patsy.IsNotFound(err) {
+			t.Fatalf("Got %v, expected not found error", err)
+		}
+	}
+	if stats := c.Stats(); stats.Dir.Hits != 0 || stats.Dirs.Commands != 2 {
+		t.Fatalf("Got %+v, expected errors not to be cached", stats)
+	}
+
+	// errors that stop go list from running are never cached, or reported as
+	// not found
+	env.(*mock.Env).Handle("go", func(ctx context.Context, cmd *exec.Cmd) error {
+		return errors.New("go tool unavailable")
+	})
+	c = patsy.NewCache(env, patsy.WithNotFoundTTL(time.Minute))
+	for i := 0; i < 2; i++ {
+		if _, err := c.Dir("ns/c"); err == nil || patsy.IsNotFound(err) {
+			t.Fatalf("Got %v, expected the error running the go tool", err)
+		}
+	}
+	if stats := c.Stats(); stats.Dir.Hits != 0 || stats.Dirs.Commands != 2 {
+		t.Fatalf("Got %+v, expected errors not to be cached", stats)
+	}
+}
@@ -0,0 +1,205 @@
+package patsy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"time"
+
+	"github.com/dave/patsy/vos"
+)
+
+// The module configuration files that govern a directory. Each has a fixed
+// position in a fingerprint so fingerprints can be compared element by element.
+const (
+	goModFile = iota
+	goSumFile
+	goWorkFile
+	modulesTxtFile
+	numConfigFiles
+)
+
+// fingerprint records the state of the module configuration files (go.mod,
+// go.sum, go.work and vendor/modules.txt) that govern a working directory.
+// When the fingerprint changes, results cached for that directory are stale.
+type fingerprint [numConfigFiles]stamp
+
+// stamp records the size, modification time and content hash of a single
+// file. A zero stamp means the file does not exist.
+type stamp struct {
+	path string
+	size int64
+	mod  time.Time
+	sum  [sha256.Size]byte
+}
+
+// configFiles returns the locations of the module configuration files that
+// govern dir. Files that are not applicable are left empty.
+func configFiles(env vos.Env, dir string) [numConfigFiles]string {
+	var files [numConfigFiles]string
+	if root, ok := findUp(env, dir, "go.mod"); ok {
+		files[goModFile] = filepath.Join(root, "go.mod")
+		files[goSumFile] = filepath.Join(root, "go.sum")
+		files[modulesTxtFile] = filepath.Join(root, "vendor", "modules.txt")
+	}
+	switch gowork := env.Getenv("GOWORK"); gowork {
+	case "off":
+	case "":
+		if root, ok := findUp(env, dir, "go.work"); ok {
+			files[goWorkFile] = filepath.Join(root, "go.work")
+		}
+	default:
+		files[goWorkFile] = gowork
+	}
+	return files
+}
+
+// findUp searches dir and its parents for a file with the given name, and
+// returns the directory containing it.
+func findUp(env vos.Env, dir, name string) (string, bool) {
+	dir = filepath.Clean(dir)
+	for {
+		if s, err := env.Stat(filepath.Join(dir, name)); err == nil && !s.IsDir() {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// refresh takes new stamps of the files, and reports whether any of them
+// differ from prev. Files are only read and hashed when their size or
+// modification time has changed since prev was taken.
+func refresh(env vos.Env, prev fingerprint, files [numConfigFiles]string) (fingerprint, bool) {
+	var next fingerprint
+	for i, fpath := range files {
+		next[i] = restamp(env, prev[i], fpath)
+	}
+	return next, !sameFiles(prev, next)
+}
+
+// sameFiles reports whether two fingerprints are of the same files with the
+// same contents.
+func sameFiles(a, b fingerprint) bool {
+	for i := range a {
+		if a[i].path != b[i].path || a[i].sum != b[i].sum {
+			return false
+		}
+	}
+	return true
+}
+
+func restamp(env vos.Env, prev stamp, fpath string) stamp {
+	if fpath == "" {
+		return stamp{}
+	}
+	s, err := env.Stat(fpath)
+	if err != nil || s.IsDir() {
+		return stamp{}
+	}
+	if prev.path == fpath && prev.size == s.Size() && prev.mod.Equal(s.ModTime()) {
+		return prev
+	}
+	b, err := env.ReadFile(fpath)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{
+		path: fpath,
+		size: s.Size(),
+		mod:  s.ModTime(),
+		sum:  sha256.Sum256(b),
+	}
+}
+
+// goEnvVars are the environment variables that affect how the go tool resolves
+// packages.
+var goEnvVars = []string{
+	"CGO_ENABLED",
+	"GO111MODULE",
+	"GOARCH",
+	"GOENV",
+	"GOEXPERIMENT",
+	"GOFLAGS",
+	"GOMODCACHE",
+	"GONOPROXY",
+	"GONOSUMDB",
+	"GOOS",
+	"GOPATH",
+	"GOPRIVATE",
+	"GOPROXY",
+	"GOROOT",
+	"GOWORK",
+}
+
+// envHash returns a hash of the environment variables that affect how the go
+// tool resolves packages, including the build options in GOFLAGS, and of the
+// state of the go env config file, where `go env -w` sets them.
+func envHash(env vos.Env) string {
+	h := sha256.New()
+	for _, name := range goEnvVars {
+		h.Write([]byte(name + "=" + env.Getenv(name) + "\x00"))
+	}
+	writeGoEnvFile(h, env, goEnvFile(env))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scope returns the dir that lookups from dir are keyed by, given the
+// fingerprint of the module configuration files governing dir. Lookups of
+// package paths and absolute dirs give the same results from every dir in a
+// module, so in module mode they are keyed by the module root (or the dir of a
+// go.work file nested inside it). In GOPATH mode they give the same results
+// from every dir that sees the same vendor dirs, so they are keyed by the
+// nearest dir containing a vendor dir, or else the GOPATH src dir. Otherwise
+// they are keyed by dir itself, as are dirs that don't exist, since lookups
+// from them fail.
+func scope(env vos.Env, dir string, fp fingerprint) string {
+	dir = filepath.Clean(dir)
+	if s, err := env.Stat(dir); err != nil || !s.IsDir() {
+		return dir
+	}
+	if fp[goModFile].path != "" && env.Getenv("GO111MODULE") != "off" {
+		root := filepath.Dir(fp[goModFile].path)
+		if work := fp[goWorkFile].path; work != "" && isUnder(filepath.Dir(work), root) {
+			root = filepath.Dir(work)
+		}
+		return root
+	}
+	if fp[goModFile].path != "" || fp[goWorkFile].path != "" {
+		return dir
+	}
+	for _, gopath := range filepath.SplitList(env.Getenv("GOPATH")) {
+		src := filepath.Join(gopath, "src")
+		if dir != src && !isUnder(dir, src) {
+			continue
+		}
+		for d := dir; d != src; d = filepath.Dir(d) {
+			if s, err := env.Stat(filepath.Join(d, "vendor")); err == nil && s.IsDir() {
+				return d
+			}
+		}
+		return src
+	}
+	return dir
+}
+
+// storeKey returns the name of the store file for dir. This is a hash of the
+// module root governing dir (or dir itself outside of a module), the contents
+// of the module configuration files and the environment.
+func storeKey(dir string, fp fingerprint, env string) string {
+	root := dir
+	if fp[goModFile].path != "" {
+		root = filepath.Dir(fp[goModFile].path)
+	}
+	h := sha256.New()
+	h.Write([]byte(root + "\x00"))
+	for _, s := range fp {
+		h.Write([]byte(s.path + "\x00"))
+		h.Write(s.sum[:])
+	}
+	h.Write([]byte(env))
+	return hex.EncodeToString(h.Sum(nil))
+}
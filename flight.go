@@ -0,0 +1,44 @@
+package patsy
+
+import "sync"
+
+// group deduplicates concurrent calls with the same key, so that cache misses
+// for the same lookup share a single call to the go tool.
+type group struct {
+	m     sync.Mutex
+	calls map[string]*call
+}
+
+// call is a call that is in flight or has completed.
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// do calls fn, unless a call with the same key is already in flight, in which
+// case it waits for that call and returns its result.
+func (g *group) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.m.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.m.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := new(call)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.m.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.m.Lock()
+	delete(g.calls, key)
+	g.m.Unlock()
+
+	return c.val, c.err
+}
@@ -0,0 +1,243 @@
+package patsy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/dave/patsy/vos"
+)
+
+// GoEnvironment is the effective Go environment, as reported by `go env`.
+// Unlike the variables of a vos.Env, it includes the defaults the go tool
+// uses for unset variables and the settings made with `go env -w`.
+type GoEnvironment struct {
+	GOPATH      string
+	GOROOT      string
+	GOMODCACHE  string
+	GOWORK      string // the go.work file in use, or "off"
+	GOFLAGS     string
+	GO111MODULE string
+	GOOS        string
+	GOARCH      string
+	GOENV       string // the go env config file, or "off"
+}
+
+// goEnvNames are the names of the fields of GoEnvironment, passed to
+// `go env -json`.
+var goEnvNames = []string{"GOPATH", "GOROOT", "GOMODCACHE", "GOWORK", "GOFLAGS", "GO111MODULE", "GOOS", "GOARCH", "GOENV"}
+
+// maxGoEnvs is the number of Go environments cached by GoEnv.
+const maxGoEnvs = 64
+
+var goEnvs = struct {
+	m      sync.Mutex
+	lru    *lru
+	flight group
+}{lru: newLRU(maxGoEnvs, 0, realClock{})}
+
+// GoEnv returns the effective Go environment of env, from `go env -json` run
+// in the working dir. If the go tool can't be run, the environment is worked
+// out from the variables of env and the go env config file in the same way as
+// the go tool. Results are cached until the variables, working dir or go env
+// config file change.
+func GoEnv(env vos.Env) GoEnvironment {
+	return goEnv(env, nil)
+}
+
+// goEnv does the same as GoEnv. If command is not nil, the run of the go tool
+// is passed to it, so a Cache can report it.
+func goEnv(env vos.Env, command func(run func() error)) GoEnvironment {
+	file := goEnvFile(env)
+	key := goEnvKey(env, file)
+	k := entryKey{arg: key}
+
+	goEnvs.m.Lock()
+	v, ok, _ := goEnvs.lru.get(k)
+	goEnvs.m.Unlock()
+	if ok {
+		return v.(GoEnvironment)
+	}
+
+	v, _ = goEnvs.flight.do(key, func() (interface{}, error) {
+		var g GoEnvironment
+		var err error
+		run := func() error {
+			g, err = goEnvCommand(env)
+			return err
+		}
+		if command != nil {
+			command(run)
+		} else {
+			run()
+		}
+		if err != nil {
+			g = goEnvFallback(env, file)
+		}
+		if g.GOMODCACHE == "" && g.GOPATH != "" {
+			// go versions before 1.15 don't report GOMODCACHE
+			g.GOMODCACHE = filepath.Join(filepath.SplitList(g.GOPATH)[0], "pkg", "mod")
+		}
+		goEnvs.m.Lock()
+		goEnvs.lru.set(k, g)
+		goEnvs.m.Unlock()
+		return g, nil
+	})
+	return v.(GoEnvironment)
+}
+
+// goEnv does the same as GoEnv, reporting a run of the go tool as a
+// GoEnvMethod command.
+func (c *Cache) goEnv(env vos.Env) GoEnvironment {
+	return goEnv(env, func(run func() error) {
+		wd, _ := env.Getwd()
+		c.command(GoEnvMethod, entryKey{wd: wd}, run)
+	})
+}
+
+// goEnvKey returns the key GoEnv caches the environment of env by: a hash of
+// the variables, the working dir and the state of the go env config file.
+func goEnvKey(env vos.Env, file string) string {
+	h := sha256.New()
+	for _, kv := range env.Environ() {
+		h.Write([]byte(kv + "\x00"))
+	}
+	wd, _ := env.Getwd()
+	h.Write([]byte(wd + "\x00"))
+	writeGoEnvFile(h, env, file)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeGoEnvFile writes the location, size and modification time of the go env
+// config file to h, so hashes change when it is written.
+func writeGoEnvFile(h io.Writer, env vos.Env, file string) {
+	fmt.Fprintf(h, "%s\x00", file)
+	if file == "" || file == "off" {
+		return
+	}
+	if s, err := env.Stat(file); err == nil {
+		fmt.Fprintf(h, "%d %d", s.Size(), s.ModTime().UnixNano())
+	}
+}
+
+func goEnvCommand(env vos.Env) (GoEnvironment, error) {
+	var g GoEnvironment
+	exe := env.Command(context.Background(), "go", append([]string{"env", "-json"}, goEnvNames...)...)
+	exe.Stderr = nil
+	out, err := exe.Output()
+	if err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal(out, &g); err != nil {
+		return g, err
+	}
+	return g, nil
+}
+
+// goEnvFallback works out the Go environment without the go tool. Variables
+// set in env take precedence over the go env config file, and unset
+// variables have the same defaults as in the go tool.
+func goEnvFallback(env vos.Env, file string) GoEnvironment {
+	config := map[string]string{}
+	if file != "" && file != "off" {
+		if b, err := env.ReadFile(file); err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				if i := strings.Index(line, "="); i > 0 {
+					config[strings.TrimSpace(line[:i])] = line[i+1:]
+				}
+			}
+		}
+	}
+	get := func(name string) string {
+		if v := env.Getenv(name); v != "" {
+			return v
+		}
+		return config[name]
+	}
+
+	g := GoEnvironment{
+		GOPATH:      get("GOPATH"),
+		GOROOT:      get("GOROOT"),
+		GOMODCACHE:  get("GOMODCACHE"),
+		GOWORK:      get("GOWORK"),
+		GOFLAGS:     get("GOFLAGS"),
+		GO111MODULE: get("GO111MODULE"),
+		GOOS:        get("GOOS"),
+		GOARCH:      get("GOARCH"),
+		GOENV:       file,
+	}
+	if g.GOROOT == "" {
+		g.GOROOT = runtime.GOROOT()
+	}
+	if g.GOPATH == "" {
+		// the default GOPATH is $HOME/go, unless that is GOROOT
+		if home := homeDir(env); home != "" && filepath.Join(home, "go") != filepath.Clean(g.GOROOT) {
+			g.GOPATH = filepath.Join(home, "go")
+		}
+	}
+	if g.GOOS == "" {
+		g.GOOS = runtime.GOOS
+	}
+	if g.GOARCH == "" {
+		g.GOARCH = runtime.GOARCH
+	}
+	if g.GOWORK == "" && g.GO111MODULE != "off" {
+		if wd, err := env.Getwd(); err == nil {
+			if root, ok := findUp(env, wd, "go.work"); ok {
+				g.GOWORK = filepath.Join(root, "go.work")
+			}
+		}
+	}
+	return g
+}
+
+// goEnvFile returns the location of the go env config file: GOENV, or else
+// go/env in the user config dir.
+func goEnvFile(env vos.Env) string {
+	if file := env.Getenv("GOENV"); file != "" {
+		return file
+	}
+	var dir string
+	switch runtime.GOOS {
+	case "windows":
+		dir = env.Getenv("AppData")
+	case "darwin", "ios":
+		if home := homeDir(env); home != "" {
+			dir = filepath.Join(home, "Library", "Application Support")
+		}
+	case "plan9":
+		if home := homeDir(env); home != "" {
+			dir = filepath.Join(home, "lib")
+		}
+	default:
+		dir = env.Getenv("XDG_CONFIG_HOME")
+		if !filepath.IsAbs(dir) {
+			dir = ""
+			if home := homeDir(env); home != "" {
+				dir = filepath.Join(home, ".config")
+			}
+		}
+	}
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "go", "env")
+}
+
+// homeDir returns the home dir of the user in env.
+func homeDir(env vos.Env) string {
+	switch runtime.GOOS {
+	case "windows":
+		return env.Getenv("USERPROFILE")
+	case "plan9":
+		return env.Getenv("home")
+	}
+	return env.Getenv("HOME")
+}
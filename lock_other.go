@@ -0,0 +1,35 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package patsy
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// staleLock is the age after which a lock file is assumed to have been left
+// behind by a process that died.
+const staleLock = 10 * time.Second
+
+// lockFile takes an exclusive lock by creating the file at path, waiting while
+// it exists. The lock is held until unlock is called.
+func lockFile(path string) (unlock func(), err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		if s, err := os.Stat(path); err == nil && time.Since(s.ModTime()) > staleLock {
+			_ = os.Remove(path)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
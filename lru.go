@@ -0,0 +1,139 @@
+package patsy
+
+import (
+	"container/list"
+	"time"
+)
+
+// Clock provides the current time to a Cache, so that expiry can be tested
+// deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// lru is a map that optionally holds at most max entries, evicting the least
+// recently used, and optionally expires entries ttl after they are set. A zero
+// max or ttl means no limit. It is not safe for concurrent use.
+type lru struct {
+	max   int
+	ttl   time.Duration
+	clock Clock
+	items map[entryKey]*list.Element
+	order *list.List // most recently used at the front
+
+	evictions int64 // entries evicted because the map was full or they expired
+}
+
+type lruItem struct {
+	key   entryKey
+	value interface{}
+	added time.Time
+}
+
+func newLRU(max int, ttl time.Duration, clock Clock) *lru {
+	return &lru{
+		max:   max,
+		ttl:   ttl,
+		clock: clock,
+		items: make(map[entryKey]*list.Element),
+		order: list.New(),
+	}
+}
+
+// get returns the value for k, and marks it as recently used. Entries that have
+// expired are removed and returned as evicted.
+func (l *lru) get(k entryKey) (value interface{}, ok bool, evicted []lruItem) {
+	e, ok := l.items[k]
+	if !ok {
+		return nil, false, nil
+	}
+	item := e.Value.(*lruItem)
+	if l.expired(item) {
+		l.evict(k)
+		return nil, false, []lruItem{*item}
+	}
+	l.order.MoveToFront(e)
+	return item.value, true, nil
+}
+
+// set adds or replaces the value for k, and returns any entries evicted to make
+// room for it.
+func (l *lru) set(k entryKey, v interface{}) (evicted []lruItem) {
+	return l.setAt(k, v, l.clock.Now())
+}
+
+// setAt is the same as set, but the entry expires ttl after added rather than
+// after now.
+func (l *lru) setAt(k entryKey, v interface{}, added time.Time) (evicted []lruItem) {
+	if e, ok := l.items[k]; ok {
+		item := e.Value.(*lruItem)
+		item.value = v
+		item.added = added
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.items[k] = l.order.PushFront(&lruItem{key: k, value: v, added: added})
+	for l.max > 0 && l.order.Len() > l.max {
+		item := l.order.Back().Value.(*lruItem)
+		l.evict(item.key)
+		evicted = append(evicted, *item)
+	}
+	return evicted
+}
+
+// has reports whether there is an entry for k, without marking it as used.
+func (l *lru) has(k entryKey) bool {
+	_, ok := l.items[k]
+	return ok
+}
+
+// remove deletes the entry for k, if any.
+func (l *lru) remove(k entryKey) {
+	if e, ok := l.items[k]; ok {
+		l.order.Remove(e)
+		delete(l.items, k)
+	}
+}
+
+// evict deletes the entry for k, if any, and counts it as evicted.
+func (l *lru) evict(k entryKey) {
+	if _, ok := l.items[k]; ok {
+		l.remove(k)
+		l.evictions++
+	}
+}
+
+// filter deletes the entries for which fn returns true.
+func (l *lru) filter(fn func(k entryKey, v interface{}) bool) {
+	for k, e := range l.items {
+		if fn(k, e.Value.(*lruItem).value) {
+			l.order.Remove(e)
+			delete(l.items, k)
+		}
+	}
+}
+
+// each calls fn for every entry that has not expired.
+func (l *lru) each(fn func(k entryKey, v interface{})) {
+	for k, e := range l.items {
+		if item := e.Value.(*lruItem); !l.expired(item) {
+			fn(k, item.value)
+		}
+	}
+}
+
+// clear deletes all entries.
+func (l *lru) clear() {
+	l.items = make(map[entryKey]*list.Element)
+	l.order.Init()
+}
+
+func (l *lru) expired(item *lruItem) bool {
+	return l.ttl > 0 && l.clock.Now().Sub(item.added) >= l.ttl
+}
@@ -6,9 +6,13 @@ package patsy
 //go:generate becca -package=github.com/dave/patsy
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"go/build"
-	"os"
-	"os/exec"
+	"io"
+	"io/ioutil"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -19,23 +23,42 @@ import (
 // Name returns the package name for a given path and src dir. Note that
 // the src dir (e.g. working dir) is required because multiple vendored
 // packages can correspond to the same path when accessed from different dirs.
+// A relative src dir is resolved from the working dir of env.
 func Name(env vos.Env, packagePath string, srcDir string) (string, error) {
-	c := build.Default
-	c.GOPATH = env.Getenv("GOPATH")
-
-	// change dir to the srcDir because go/build uses os.Getwd when go modules is enabled
-	err := os.Chdir(srcDir)
+	srcDir, err := env.Abs(srcDir)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	if env.Getenv("GO111MODULE") != "off" {
+		// In module mode go/build runs the go tool in the working dir and
+		// environment of the process, so run go list with env instead.
+		exe := env.Command(context.Background(), "go", "list", "-f", "{{.Name}}", packagePath)
+		exe.Dir = srcDir
+		stderr := &bytes.Buffer{}
+		exe.Stderr = stderr
+		out, err := exe.Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "importing %s: %s", packagePath, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
 
-	// go/build package relies on `os.Getenv` ... and this causes issues in go1.15
-	// so we have to set and unset GO111MODULE=off from our vos.Env
-	go111Mod := env.Getenv("GO111MODULE")
-	originalGo111Mod := os.Getenv("GO111MODULE")
-	if go111Mod != originalGo111Mod {
-		_ = os.Setenv("GO111MODULE", go111Mod)
-		defer func() { _ = os.Setenv("GO111MODULE", originalGo111Mod) }()
+	// In GOPATH mode go/build reads the filesystem itself, so it can use the
+	// filesystem of env, and srcDir need not exist on disk. Setting these hooks
+	// also stops go/build running the go tool, so the process is left alone.
+	c := build.Default
+	c.GOPATH = env.Getenv("GOPATH")
+	c.IsDir = func(path string) bool {
+		s, err := env.Stat(path)
+		return err == nil && s.IsDir()
+	}
+	c.ReadDir = env.ReadDir
+	c.OpenFile = func(path string) (io.ReadCloser, error) {
+		b, err := env.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
 	}
 
 	p, err := c.Import(packagePath, srcDir, 0)
@@ -57,34 +80,85 @@ func Dir(env vos.Env, packagePath string) (string, error) {
 		}
 	}
 
-	// The go list command will throw an error if the package directory is
-	// empty. In this case we need to explore the filesystem to see if there is
-	// a directory in <gopath>/src/<package-path>. Remember there can be
-	// several gopaths. We return the first matching directory.
-	if env.Getenv("GOPATH") != "" {
-		for _, gopath := range filepath.SplitList(env.Getenv("GOPATH")) {
-			dir := filepath.Join(gopath, "src", packagePath)
-			if s, err := os.Stat(dir); err == nil && s.IsDir() {
-				return dir, nil
-			}
-		}
+	if dir, ok := gopathDir(env, GoEnv(env).GOPATH, packagePath); ok {
+		return dir, nil
+	}
+
+	if err != nil && !isListError(err) {
+		// the go tool couldn't be run, or failed for another reason
+		return "", err
 	}
+	return "", errors.WithStack(&NotFoundError{Path: packagePath})
+}
+
+// NotFoundError is the cause of the error returned by Dir when a package path
+// can't be found, and by Path when a directory is not a package. Errors that
+// stop go list from running, or from loading the module, are returned as they
+// are.
+type NotFoundError struct {
+	Path string // the package path passed to Dir
+	Dir  string // the directory passed to Path
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Dir != "" {
+		return fmt.Sprintf("Package not found for %s", e.Dir)
+	}
+	return fmt.Sprintf("Dir not found for %s", e.Path)
+}
+
+// IsNotFound reports whether the cause of err is a *NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := errors.Cause(err).(*NotFoundError)
+	return ok
+}
 
-	return "", errors.Errorf("Dir not found for %s", packagePath)
+// listError is the cause of the error returned by Dirs when go list ran, but
+// could not load some of the packages it matched, e.g. because they don't
+// exist or have no Go files.
+type listError struct {
+	paths []string // the package paths or dirs that could not be loaded
+}
+
+func (e *listError) Error() string {
+	return fmt.Sprintf("Error loading %s", strings.Join(e.paths, ", "))
+}
+
+// isListError reports whether the cause of err is a *listError. Dir and Path
+// only report that a package is not found after go list has run, so other
+// errors (e.g. the go tool is missing, or fails to load the module graph) are
+// not mistaken for a missing package.
+func isListError(err error) bool {
+	_, ok := errors.Cause(err).(*listError)
+	return ok
+}
+
+// gopathDir finds the directory for a package path by exploring the gopaths.
+// The go list command will throw an error if the package directory is empty.
+// In this case we need to explore the filesystem to see if there is a
+// directory in <gopath>/src/<package-path>. Remember there can be several
+// gopaths, and GOPATH may be unset and default to $HOME/go, so the effective
+// GOPATH from GoEnv is passed in. We return the first matching directory.
+func gopathDir(env vos.Env, gopaths, packagePath string) (string, bool) {
+	for _, gopath := range filepath.SplitList(gopaths) {
+		dir := filepath.Join(gopath, "src", packagePath)
+		if s, err := env.Stat(dir); err == nil && s.IsDir() {
+			return dir, true
+		}
+	}
+	return "", false
 }
 
 // Dirs returns the filesystem path for all packages under the directory corresponding to the go
 // package path provided.
 func Dirs(env vos.Env, packagePath string) (map[string]string, error) {
-	wd, err := env.Getwd()
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	exe := exec.Command("go", "list", "-f", "{{.ImportPath}}:{{.Dir}}", packagePath)
-	exe.Dir = wd
-	exe.Env = env.Environ()
-	out, err := exe.CombinedOutput()
+	// with -e go list still lists packages that can't be loaded, so they can
+	// be told apart from failures of the go tool itself. Packages that can't
+	// be loaded are marked with a "!". Packages that only have errors in their
+	// dependencies are still listed with their dir.
+	exe := env.Command(context.Background(), "go", "list", "-e", "-f", "{{if .Error}}!{{end}}{{.ImportPath}}:{{.Dir}}", packagePath)
+	exe.Stderr = ioutil.Discard
+	out, err := exe.Output()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -92,9 +166,10 @@ func Dirs(env vos.Env, packagePath string) (map[string]string, error) {
 	lines := strings.Split(string(out), "\n")
 
 	result := make(map[string]string, len(lines))
+	var failed []string
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "go: warning:") {
+		if line == "" {
 			continue
 		}
 
@@ -102,8 +177,15 @@ func Dirs(env vos.Env, packagePath string) (map[string]string, error) {
 		importPath := chunks[0]
 		dir := chunks[1]
 
+		if strings.HasPrefix(importPath, "!") {
+			failed = append(failed, strings.TrimPrefix(importPath, "!"))
+			continue
+		}
 		result[importPath] = dir
 	}
+	if len(failed) > 0 {
+		return nil, errors.WithStack(&listError{paths: failed})
+	}
 
 	return result, nil
 }
@@ -111,8 +193,13 @@ func Dirs(env vos.Env, packagePath string) (map[string]string, error) {
 // Path returns the go package path corresponding to the filesystem directory
 // provided.
 func Path(env vos.Env, packageDir string) (string, error) {
+	return lookupPath(env, packageDir, GoEnv)
+}
+
+// lookupPath does the same as Path, using goEnv for the GOPATH fallback.
+func lookupPath(env vos.Env, packageDir string, goEnv func(vos.Env) GoEnvironment) (string, error) {
 	// packageDir needs to match what `go list` will be returning, so eval symlinks and clean
-	packageDir, err := filepath.EvalSymlinks(filepath.Clean(packageDir))
+	packageDir, err := env.EvalSymlinks(filepath.Clean(packageDir))
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -130,19 +217,96 @@ func Path(env vos.Env, packageDir string) (string, error) {
 	// The go list command will throw an error if the package directory is
 	// empty. In this case we need to explore the filesystem to see if there is
 	// a directory in <gopath>/src/<package-path>. Remember there can be
-	// several gopaths. We return the first matching directory.
-	if env.Getenv("GOPATH") != "" {
-		for _, gopath := range filepath.SplitList(env.Getenv("GOPATH")) {
-			if strings.HasPrefix(packageDir, gopath) {
-				rel, inner := filepath.Rel(filepath.Join(gopath, "src"), packageDir)
-				if inner == nil && rel != "" {
-					// Remember we're returning a package path, which uses forward
-					// slashes even on windows
-					return filepath.ToSlash(rel), nil
-				}
+	// several gopaths, and GOPATH may default to $HOME/go. We return the first
+	// matching directory.
+	for _, gopath := range filepath.SplitList(goEnv(env).GOPATH) {
+		if strings.HasPrefix(packageDir, gopath) {
+			rel, inner := filepath.Rel(filepath.Join(gopath, "src"), packageDir)
+			if inner == nil && rel != "" {
+				// Remember we're returning a package path, which uses forward
+				// slashes even on windows
+				return filepath.ToSlash(rel), nil
+			}
+		}
+	}
+
+	if err != nil && !isListError(err) {
+		return "", err
+	}
+	return "", errors.WithStack(&NotFoundError{Dir: packageDir})
+}
+
+// GoName converts a full filepath to a package path and filename:
+//
+//	/Users/dave/go/src/github.com/dave/foo.go -> github.com/dave/foo.go
+func GoName(env vos.Env, fpath string) (string, error) {
+	names, err := GoNames(env, []string{fpath})
+	if err != nil {
+		return "", err
+	}
+	return names[0], nil
+}
+
+// GoNames does the same as GoName for several files. The files are grouped by
+// directory, so each directory is only resolved once.
+func GoNames(env vos.Env, fpaths []string) ([]string, error) {
+	return goNames(fpaths, func(dir string) (string, error) { return Path(env, dir) })
+}
+
+// FilePath converts a package path and filename to a full filepath:
+//
+//	github.com/dave/foo.go -> /Users/dave/go/src/github.com/dave/foo.go
+func FilePath(env vos.Env, gpath string) (string, error) {
+	fpaths, err := FilePaths(env, []string{gpath})
+	if err != nil {
+		return "", err
+	}
+	return fpaths[0], nil
+}
+
+// FilePaths does the same as FilePath for several files. The files are
+// grouped by package path, so each package is only resolved once.
+func FilePaths(env vos.Env, gpaths []string) ([]string, error) {
+	return filePaths(gpaths, func(ppath string) (string, error) { return Dir(env, ppath) })
+}
+
+// goNames converts filepaths to package paths and filenames, using toPath to
+// resolve each directory once.
+func goNames(fpaths []string, toPath func(dir string) (string, error)) ([]string, error) {
+	ppaths := map[string]string{}
+	names := make([]string, len(fpaths))
+	for i, fpath := range fpaths {
+		fdir, fname := filepath.Split(fpath)
+		ppath, ok := ppaths[fdir]
+		if !ok {
+			var err error
+			if ppath, err = toPath(fdir); err != nil {
+				return nil, err
 			}
+			ppaths[fdir] = ppath
 		}
+		names[i] = path.Join(ppath, fname)
 	}
+	return names, nil
+}
 
-	return "", errors.Errorf("Package not found for %s", packageDir)
+// filePaths converts package paths and filenames to filepaths, using toDir to
+// resolve each package path once.
+func filePaths(gpaths []string, toDir func(ppath string) (string, error)) ([]string, error) {
+	dirs := map[string]string{}
+	fpaths := make([]string, len(gpaths))
+	for i, gpath := range gpaths {
+		ppath, fname := path.Split(gpath)
+		ppath = strings.TrimSuffix(ppath, "/")
+		dir, ok := dirs[ppath]
+		if !ok {
+			var err error
+			if dir, err = toDir(ppath); err != nil {
+				return nil, err
+			}
+			dirs[ppath] = dir
+		}
+		fpaths[i] = filepath.Join(dir, fname)
+	}
+	return fpaths, nil
 }
@@ -1,15 +1,25 @@
 package patsy_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dave/patsy"
 	"github.com/dave/patsy/builder"
 	"github.com/dave/patsy/vos"
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/mock"
+	"github.com/dave/patsy/vos/record"
+	"github.com/pkg/errors"
 )
 
 func TestName2(t *testing.T) {
@@ -79,6 +89,70 @@ func TestName2(t *testing.T) {
 	}
 }
 
+// In gomod mode the error from the go tool explains why the package can't be
+// imported.
+func TestNameMissingGoMod(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	_, err = patsy.Name(env, "ns/missing", b.Root())
+	if err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	if !strings.Contains(err.Error(), "package ns/missing") {
+		t.Fatalf("Got %v, expected the reason ns/missing can't be imported", err)
+	}
+}
+
+func TestNameRelativeSrcDir(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePath, _, err := b.Package("x/a", map[string]string{
+				"a.go": "package b",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the src dir is relative to the working dir of env, not of the
+			// process (the builder root)
+			if err := env.Setwd(filepath.Join(b.Root(), "x")); err != nil {
+				t.Fatal(err)
+			}
+			name, err := patsy.Name(env, packagePath, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "b" {
+				t.Fatalf("Got %s, Expected b", name)
+			}
+
+			// and the Cache keys it by the resolved dir
+			c := patsy.NewCache(env)
+			if name, err := c.Name(packagePath, "a"); err != nil || name != "b" {
+				t.Fatalf("Got %s, %v, expected b", name, err)
+			}
+			if err := env.Setwd(b.Root()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Name(packagePath, "a"); err == nil && gomod {
+				t.Fatal("Expected error, got none.")
+			}
+		})
+	}
+}
+
 func TestNameGoPathFromAnywhere(t *testing.T) {
 	env := vos.Mock()
 	b, err := builder.New(env, "ns", false)
@@ -289,6 +363,57 @@ func TestDirNoSrcGoMod(t *testing.T) {
 	}
 }
 
+// Packages with a broken import are still found.
+func TestDirBrokenImport(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePath, packageDir, err := b.Package("a", map[string]string{
+				"a.go": "package a\n\nimport _ \"ns/nope\"\n",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			calculatedDir, err := patsy.Dir(env, packagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calculatedDir != packageDir {
+				t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+			}
+			calculatedPath, err := patsy.Path(env, packageDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calculatedPath != packagePath {
+				t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+			}
+			dirs, err := patsy.Dirs(env, packagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dirs[packagePath] != packageDir {
+				t.Fatalf("Got %v, expected %s", dirs, packageDir)
+			}
+
+			// and the Cache doesn't store them as not found
+			c := patsy.NewCache(env, patsy.WithNotFoundTTL(time.Hour))
+			for i := 0; i < 2; i++ {
+				if calculatedDir, err := c.Dir(packagePath); err != nil || calculatedDir != packageDir {
+					t.Fatalf("Got %s, %v, expected %s", calculatedDir, err, packageDir)
+				}
+			}
+		})
+	}
+}
+
 func TestDirs(t *testing.T) {
 	for _, gomod := range []bool{false, true} {
 		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
@@ -377,3 +502,854 @@ func TestDirsSubpackages(t *testing.T) {
 		})
 	}
 }
+
+func TestGoNamesFilePaths(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePathA, packageDirA, err := b.Package("a", map[string]string{
+				"a.go": "package a",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			packagePathB, packageDirB, err := b.Package("b", map[string]string{
+				"b.go": "package b",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fpaths := []string{
+				filepath.Join(packageDirA, "a.go"),
+				filepath.Join(packageDirB, "b.go"),
+				filepath.Join(packageDirA, "a_test.go"),
+			}
+			gpaths := []string{
+				path.Join(packagePathA, "a.go"),
+				path.Join(packagePathB, "b.go"),
+				path.Join(packagePathA, "a_test.go"),
+			}
+
+			calculatedNames, err := patsy.GoNames(env, fpaths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(calculatedNames) != fmt.Sprint(gpaths) {
+				t.Fatalf("Got %v, expected %v", calculatedNames, gpaths)
+			}
+			calculatedName, err := patsy.GoName(env, fpaths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calculatedName != gpaths[0] {
+				t.Fatalf("Got %s, expected %s", calculatedName, gpaths[0])
+			}
+
+			calculatedPaths, err := patsy.FilePaths(env, gpaths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(calculatedPaths) != fmt.Sprint(fpaths) {
+				t.Fatalf("Got %v, expected %v", calculatedPaths, fpaths)
+			}
+			calculatedPath, err := patsy.FilePath(env, gpaths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calculatedPath != fpaths[0] {
+				t.Fatalf("Got %s, expected %s", calculatedPath, fpaths[0])
+			}
+
+			if _, err := patsy.FilePaths(env, []string{gpaths[0], "ns/c/c.go"}); !patsy.IsNotFound(err) {
+				t.Fatalf("Got %v, expected not found error", err)
+			}
+		})
+	}
+}
+
+func TestWalkPackages(t *testing.T) {
+	for _, gomod := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			for _, name := range []string{"a", "a/b", "c"} {
+				if _, _, err := b.Package(name, map[string]string{
+					"a.go": "package " + path.Base(name),
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := patsy.Dirs(env, "ns/...")
+			if err != nil {
+				t.Fatal(err)
+			}
+			walked := map[string]string{}
+			if err := patsy.WalkPackages(context.Background(), env, "ns/...", func(p patsy.Package) error {
+				if p.Err != nil {
+					return p.Err
+				}
+				if p.Name != path.Base(p.ImportPath) {
+					t.Fatalf("Got %s, expected %s", p.Name, path.Base(p.ImportPath))
+				}
+				walked[p.ImportPath] = p.Dir
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(walked) != fmt.Sprint(expected) {
+				t.Fatalf("Got %v, expected %v", walked, expected)
+			}
+
+			// the walk can be stopped early
+			var count int
+			if err := patsy.WalkPackages(context.Background(), env, "ns/...", func(p patsy.Package) error {
+				count++
+				return patsy.StopWalk
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 {
+				t.Fatalf("Got %d packages, expected 1", count)
+			}
+			stop := errors.New("stop")
+			if err := patsy.WalkPackages(context.Background(), env, "ns/...", func(p patsy.Package) error {
+				return stop
+			}); err != stop {
+				t.Fatalf("Got %v, expected %v", err, stop)
+			}
+
+			// packages that can't be loaded are reported with an error
+			if err := patsy.WalkPackages(context.Background(), env, "ns/d", func(p patsy.Package) error {
+				if p.Err == nil {
+					t.Fatalf("Expected error for %s, got none.", p.ImportPath)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// virtualEnv overrides some of the filesystem methods of an Env.
+type virtualEnv struct {
+	vos.Env
+	links map[string]string // symlinks that only exist in the Env
+	files map[string]string // file contents that only exist in the Env
+}
+
+func (e *virtualEnv) EvalSymlinks(path string) (string, error) {
+	if target, ok := e.links[path]; ok {
+		return target, nil
+	}
+	return e.Env.EvalSymlinks(path)
+}
+
+func (e *virtualEnv) ReadFile(filename string) ([]byte, error) {
+	if contents, ok := e.files[filename]; ok {
+		return []byte(contents), nil
+	}
+	return e.Env.ReadFile(filename)
+}
+
+func TestFilesystemEnv(t *testing.T) {
+	env := &virtualEnv{Env: vos.Mock()}
+	b, err := builder.New(env, "ns", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{
+		"a.go": "package a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.links = map[string]string{"/virtual/a": packageDir}
+	env.files = map[string]string{filepath.Join(packageDir, "a.go"): "package virtual"}
+
+	calculatedPath, err := patsy.Path(env, "/virtual/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedPath != packagePath {
+		t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+	}
+
+	calculatedName, err := patsy.Name(env, packagePath, b.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedName != "virtual" {
+		t.Fatalf("Got %s, expected virtual", calculatedName)
+	}
+}
+
+// memFS returns a mock Env using an in-memory GOPATH at /patsy/gopath, which
+// contains the files provided.
+func memFS(t *testing.T, files map[string]string) vos.Env {
+	fs := mock.NewFS()
+	for name, contents := range files {
+		if err := fs.MkdirAll(filepath.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+		if contents == "" {
+			continue
+		}
+		if err := fs.WriteFile(name, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := vos.MockFS(fs)
+	env.Setenv("GOPATH", "/patsy/gopath")
+	env.Setenv("GO111MODULE", "off")
+	env.Setwd("/patsy/gopath")
+	return env
+}
+
+func TestMockFS(t *testing.T) {
+	t.Parallel()
+	env := memFS(t, map[string]string{
+		"/patsy/gopath/src/ns/a/a.go":                  "package a",
+		"/patsy/gopath/src/ns/a/a_test.go":             "package a_test",
+		"/patsy/gopath/src/ns/b/b.go":                  "// Package b\npackage bee // import \"ns/b\"",
+		"/patsy/gopath/src/ns/vendor/ns/a/a.go":        "package vendored",
+		"/patsy/gopath/src/ns/empty/":                  "",
+		"/patsy/gopath/src/ns/empty/sub/":              "",
+		"/patsy/gopath/src/other/c/c.go":               "package c",
+		"/patsy/gopath/src/other/c/testdata/ignore.go": "package ignore",
+	})
+	if err := env.(*mock.Env).FS().Symlink("/patsy/gopath/src/ns/a", "/patsy/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []struct{ path, srcDir, expected string }{
+		{"ns/a", "/patsy/gopath/src/other", "a"},
+		{"ns/a", "/patsy/gopath/src/ns", "vendored"},
+		{"ns/b", "/patsy/gopath/src/ns", "bee"},
+		{"other/c", "/patsy/gopath/src/ns", "c"},
+		{"./a", "/patsy/gopath/src/ns", "a"},
+	}
+	for _, n := range names {
+		calculated, err := patsy.Name(env, n.path, n.srcDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculated != n.expected {
+			t.Fatalf("Name(%s, %s): got %s, expected %s", n.path, n.srcDir, calculated, n.expected)
+		}
+	}
+	if _, err := patsy.Name(env, "ns/missing", "/patsy/gopath/src/ns"); err == nil {
+		t.Fatal("Name(ns/missing): expected error")
+	}
+
+	dir, err := patsy.Dir(env, "ns/empty/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "/patsy/gopath/src/ns/empty/sub" {
+		t.Fatalf("Dir: got %s, expected /patsy/gopath/src/ns/empty/sub", dir)
+	}
+	// the go tool can't run in a dir that is only in memory, so the error is
+	// passed on rather than reported as not found
+	if _, err := patsy.Dir(env, "ns/missing"); err == nil || patsy.IsNotFound(err) {
+		t.Fatalf("Dir(ns/missing): got %v, expected the error running the go tool", err)
+	}
+
+	ppath, err := patsy.Path(env, "/patsy/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppath != "ns/a" {
+		t.Fatalf("Path: got %s, expected ns/a", ppath)
+	}
+	if _, err := patsy.Path(env, "/patsy/missing"); err == nil {
+		t.Fatal("Path(/patsy/missing): expected error")
+	}
+}
+
+func TestMockEnviron(t *testing.T) {
+	env := vos.Mock()
+	if err := env.Setenv("GOFLAGS", "-ldflags=-X=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("PATSY_EMPTY", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Unsetenv("GOPATH"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("A=B", "c"); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+
+	if v, ok := env.LookupEnv("PATSY_EMPTY"); v != "" || !ok {
+		t.Fatalf("Got %q, %v, expected an empty value", v, ok)
+	}
+	if v, ok := env.LookupEnv("GOPATH"); v != "" || ok {
+		t.Fatalf("Got %q, %v, expected GOPATH to be unset", v, ok)
+	}
+
+	environ := env.Environ()
+	var keys []string
+	var found bool
+	for _, kv := range environ {
+		keys = append(keys, strings.SplitN(kv, "=", 2)[0])
+		if strings.HasPrefix(kv, "GOPATH=") {
+			t.Fatalf("Got %s, expected GOPATH to be unset", kv)
+		}
+		if kv == "GOFLAGS=-ldflags=-X=a" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Got %v, expected GOFLAGS=-ldflags=-X=a", environ)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("Got %v, expected sorted keys", keys)
+	}
+
+	env.Clearenv()
+	if err := env.Setenv("PATSY", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if environ := env.Environ(); len(environ) != 1 || environ[0] != "PATSY=1" {
+		t.Fatalf("Got %v, expected only PATSY=1", environ)
+	}
+	if _, ok := env.LookupEnv("PATH"); ok {
+		t.Fatal("Expected PATH to be cleared")
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	t.Parallel()
+	env := memFS(t, map[string]string{
+		"/patsy/gopath/src/ns/a/a.go": "package a",
+	}).(*mock.Env)
+	if err := env.Setenv("GOFLAGS", "-tags=patsy"); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	env.Handle("go", func(ctx context.Context, cmd *exec.Cmd) error {
+		if cmd.Dir != "/patsy/gopath" {
+			t.Errorf("Got dir %s, expected /patsy/gopath", cmd.Dir)
+		}
+		var goflags string
+		for _, kv := range cmd.Env {
+			if strings.HasPrefix(kv, "GOFLAGS=") {
+				goflags = kv
+			}
+		}
+		if goflags != "GOFLAGS=-tags=patsy" {
+			t.Errorf("Got %q, expected GOFLAGS=-tags=patsy", goflags)
+		}
+		calls = append(calls, strings.Join(cmd.Args[1:], " "))
+		switch strings.Join(cmd.Args[1:], " ") {
+		case "list -e -f {{if .Error}}!{{end}}{{.ImportPath}}:{{.Dir}} ns/a", "list -e -f {{if .Error}}!{{end}}{{.ImportPath}}:{{.Dir}} /patsy/gopath/src/ns/a":
+			fmt.Fprintln(cmd.Stdout, "ns/a:/patsy/gopath/src/ns/a")
+			return nil
+		case "list -e -json ./...":
+			for i := 0; ; i++ {
+				if _, err := fmt.Fprintf(cmd.Stdout, `{"ImportPath": "ns/p%d", "Dir": "/patsy/gopath/src/ns/p%d", "Name": "p%d"}`+"\n", i, i, i); err != nil {
+					return &exec.ExitError{Code: 2}
+				}
+			}
+		}
+		fmt.Fprintln(cmd.Stderr, "can't load package")
+		return &exec.ExitError{Code: 1}
+	})
+
+	dir, err := patsy.Dir(env, "ns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "/patsy/gopath/src/ns/a" {
+		t.Fatalf("Got %s, expected /patsy/gopath/src/ns/a", dir)
+	}
+	ppath, err := patsy.Path(env, "/patsy/gopath/src/ns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppath != "ns/a" {
+		t.Fatalf("Got %s, expected ns/a", ppath)
+	}
+	if _, err := patsy.Dirs(env, "ns/missing"); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+
+	// the fake go tool lists packages forever, so the walk has to stop it
+	var walked []string
+	err = patsy.WalkPackages(context.Background(), env, "./...", func(p patsy.Package) error {
+		walked = append(walked, p.ImportPath)
+		if len(walked) == 3 {
+			return patsy.StopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(walked, " ") != "ns/p0 ns/p1 ns/p2" {
+		t.Fatalf("Got %v, expected ns/p0 ns/p1 ns/p2", walked)
+	}
+	if len(calls) != 4 {
+		t.Fatalf("Got %v, expected 4 commands", calls)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := record.New(env)
+	if _, err := patsy.Dir(recorder, packagePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := patsy.Dirs(recorder, "ns/missing"); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	if err := patsy.WalkPackages(context.Background(), recorder, "./...", func(patsy.Package) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// in module mode Name runs the go tool from the src dir
+	if _, err := patsy.Name(recorder, packagePath, packageDir); err != nil {
+		t.Fatal(err)
+	}
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+	if err := recorder.Save(fixture); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Invocations()) != 4 {
+		t.Fatalf("Got %+v, expected 4 invocations", recorder.Invocations())
+	}
+
+	// the recordings are served without running the go tool, so they don't
+	// depend on the filesystem
+	if err := os.RemoveAll(packageDir); err != nil {
+		t.Fatal(err)
+	}
+	player, err := record.Open(env, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		calculatedDir, err := patsy.Dir(player, packagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calculatedDir != packageDir {
+			t.Fatalf("Got %s, expected %s", calculatedDir, packageDir)
+		}
+	}
+	if _, err := patsy.Dirs(player, "ns/missing"); err == nil {
+		t.Fatal("Expected error, got none.")
+	}
+	var walked []string
+	if err := patsy.WalkPackages(context.Background(), player, "./...", func(p patsy.Package) error {
+		walked = append(walked, p.ImportPath)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || walked[0] != packagePath {
+		t.Fatalf("Got %v, expected %s", walked, packagePath)
+	}
+	calculatedName, err := patsy.Name(player, packagePath, packageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedName != "a" {
+		t.Fatalf("Got %s, expected a", calculatedName)
+	}
+
+	// runs in a different environment aren't served
+	if err := env.Setenv("GOFLAGS", "-tags=patsy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := patsy.Dirs(player, packagePath); err == nil || !strings.Contains(err.Error(), "no recording") {
+		t.Fatalf("Got %v, expected no recording", err)
+	}
+}
+
+func TestRecordReplayRoot(t *testing.T) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packagePath, packageDir, err := b.Package("a", map[string]string{"a.go": "package a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.New(env, record.WithRoot(b.Root()))
+	if _, err := patsy.Dir(recorder, packagePath); err != nil {
+		t.Fatal(err)
+	}
+	// Path passes the absolute dir to go list
+	if _, err := patsy.Path(recorder, packageDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := patsy.Name(recorder, packagePath, packageDir); err != nil {
+		t.Fatal(err)
+	}
+	invocations := recorder.Invocations()
+	if len(invocations) != 3 {
+		t.Fatalf("Got %+v, expected 3 invocations", invocations)
+	}
+	for _, i := range invocations {
+		if !strings.HasPrefix(i.Dir, record.Root) || strings.Contains(fmt.Sprint(i), b.Root()) {
+			t.Fatalf("Got %+v, expected a run in %s", i, record.Root)
+		}
+	}
+
+	// the recordings are served under another root, and variables that depend
+	// on the machine are ignored. Path needs the dir to exist.
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "a"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	moved := vos.Fork(env)
+	if err := moved.Setwd(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := moved.Setenv("GOCACHE", filepath.Join(root, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	player := record.Replay(moved, invocations, record.WithRoot(root))
+	calculatedDir, err := patsy.Dir(player, packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(root, "a"); calculatedDir != expected {
+		t.Fatalf("Got %s, expected %s", calculatedDir, expected)
+	}
+	calculatedPath, err := patsy.Path(player, filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedPath != packagePath {
+		t.Fatalf("Got %s, expected %s", calculatedPath, packagePath)
+	}
+	calculatedName, err := patsy.Name(player, packagePath, filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calculatedName != "a" {
+		t.Fatalf("Got %s, expected a", calculatedName)
+	}
+}
+
+func TestFork(t *testing.T) {
+	parent := vos.Mock()
+	if err := parent.Setenv("PATSY_A", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Setwd(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := vos.Overlay(parent, map[string]string{"PATSY_B": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Unsetenv("PATSY_A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Setwd("sub"); err != nil {
+		t.Fatal(err)
+	}
+	child.Setstdout(&bytes.Buffer{})
+
+	if v, ok := parent.LookupEnv("PATSY_A"); v != "a" || !ok {
+		t.Fatalf("Got %q, %v, expected the parent to be unchanged", v, ok)
+	}
+	if _, ok := parent.LookupEnv("PATSY_B"); ok {
+		t.Fatal("Expected PATSY_B to only be set in the child")
+	}
+	if _, ok := child.LookupEnv("PATSY_A"); ok {
+		t.Fatal("Expected PATSY_A to be unset in the child")
+	}
+	parentWd, _ := parent.Getwd()
+	childWd, _ := child.Getwd()
+	if childWd != filepath.Join(parentWd, "sub") {
+		t.Fatalf("Got %s, expected %s", childWd, filepath.Join(parentWd, "sub"))
+	}
+	if parent.Stdout() == child.Stdout() {
+		t.Fatal("Expected the child to have its own stdout")
+	}
+
+	// variables the child hasn't set follow the parent
+	if err := parent.Setenv("PATSY_C", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if v := child.Getenv("PATSY_C"); v != "c" {
+		t.Fatalf("Got %q, expected c", v)
+	}
+	var found bool
+	for _, kv := range child.Environ() {
+		if strings.HasPrefix(kv, "PATSY_A=") {
+			t.Fatalf("Got %s, expected PATSY_A to be unset in the child", kv)
+		}
+		found = found || kv == "PATSY_B=b"
+	}
+	if !found {
+		t.Fatal("Expected PATSY_B=b in the child environ")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	env := vos.Mock()
+	wd := t.TempDir()
+	if err := env.Setwd(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("GOPATH", "/patsy/gopath"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Unsetenv("GO111MODULE"); err != nil {
+		t.Fatal(err)
+	}
+	before := env.Environ()
+
+	for _, gomod := range []bool{true, false} {
+		b, err := builder.New(env, "ns", gomod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Package("a", map[string]string{"a.go": "package a"}); err != nil {
+			t.Fatal(err)
+		}
+		b.Cleanup()
+
+		if after := env.Environ(); strings.Join(after, "\n") != strings.Join(before, "\n") {
+			t.Fatalf("gomod=%v: Got %v, expected %v", gomod, after, before)
+		}
+		if calculated, _ := env.Getwd(); calculated != wd {
+			t.Fatalf("gomod=%v: Got %s, expected %s", gomod, calculated, wd)
+		}
+		if _, err := os.Stat(b.Root()); !os.IsNotExist(err) {
+			t.Fatalf("gomod=%v: Got %v, expected the root to be deleted", gomod, err)
+		}
+	}
+
+	state := vos.Snapshot(env)
+	env.Setstdout(&bytes.Buffer{})
+	if err := env.Setenv("PATSY", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env.LookupEnv("PATSY"); ok {
+		t.Fatal("Expected PATSY to be unset")
+	}
+	if env.Stdout() != os.Stdout {
+		t.Fatal("Expected stdout to be restored")
+	}
+}
+
+func TestStrictMock(t *testing.T) {
+	t.Parallel()
+	env := mock.NewStrict(map[string]string{
+		"GOPATH":      "/patsy/gopath",
+		"GO111MODULE": "off",
+	})
+	fs := mock.NewFS()
+	if err := fs.MkdirAll("/patsy/gopath/src/ns/a"); err != nil {
+		t.Fatal(err)
+	}
+	env.SetFS(fs)
+	env.Handle("go", func(ctx context.Context, cmd *exec.Cmd) error {
+		return &exec.ExitError{Code: 1}
+	})
+
+	if _, err := env.Getwd(); err != mock.ErrNoWd {
+		t.Fatalf("Got %v, expected %v", err, mock.ErrNoWd)
+	}
+	if _, err := env.Stat("src"); err != mock.ErrNoWd {
+		t.Fatalf("Got %v, expected %v", err, mock.ErrNoWd)
+	}
+	if err := env.Command(context.Background(), "go", "version").Run(); err != mock.ErrNoWd {
+		t.Fatalf("Got %v, expected %v", err, mock.ErrNoWd)
+	}
+	if v, ok := env.LookupEnv("PATH"); ok {
+		t.Fatalf("Got %q, expected PATH to be unset", v)
+	}
+	if environ := env.Environ(); len(environ) != 2 {
+		t.Fatalf("Got %v, expected only the variables provided", environ)
+	}
+
+	if err := env.Setwd("/patsy/gopath"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := patsy.Dir(env, "ns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "/patsy/gopath/src/ns/a" {
+		t.Fatalf("Got %s, expected /patsy/gopath/src/ns/a", dir)
+	}
+
+	// the fallback GOPATH lookup reads the variables the go tool would
+	missing := " " + strings.Join(env.Missing(), " ") + " "
+	if !strings.Contains(missing, " PATH ") || !strings.Contains(missing, " GOENV ") || strings.Contains(missing, " GOPATH ") {
+		t.Fatalf("Got %s, expected PATH and GOENV but not GOPATH", missing)
+	}
+}
+
+func TestGoEnv(t *testing.T) {
+	t.Parallel()
+	// GoEnv caches results for the whole process, so each run has its own
+	// variables
+	env := mock.NewStrict(map[string]string{
+		"GOENV":       "/patsy/goenv",
+		"GO111MODULE": "off",
+		"HOME":        "/patsy/home",
+		"USERPROFILE": "/patsy/home",
+		"home":        "/patsy/home",
+		"PATSY_RUN":   fmt.Sprint(time.Now().UnixNano()),
+	})
+	fs := mock.NewFS()
+	for _, dir := range []string{"/patsy/home/go/src/ns/a", "/patsy/gopath/src/ns/b"} {
+		if err := fs.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.SetFS(fs)
+	if err := env.Setwd("/patsy"); err != nil {
+		t.Fatal(err)
+	}
+	var goenvJSON string
+	var calls int
+	env.Handle("go", func(ctx context.Context, cmd *exec.Cmd) error {
+		if cmd.Args[1] == "env" {
+			calls++
+			if goenvJSON != "" {
+				fmt.Fprint(cmd.Stdout, goenvJSON)
+				return nil
+			}
+		}
+		return &exec.ExitError{Code: 1}
+	})
+
+	// without the go tool, GOPATH defaults to $HOME/go
+	g := patsy.GoEnv(env)
+	if g.GOPATH != "/patsy/home/go" || g.GOMODCACHE != "/patsy/home/go/pkg/mod" || g.GOENV != "/patsy/goenv" {
+		t.Fatalf("Got %+v, expected the default GOPATH", g)
+	}
+	if dir, err := patsy.Dir(env, "ns/a"); err != nil || dir != "/patsy/home/go/src/ns/a" {
+		t.Fatalf("Got %s, %v, expected /patsy/home/go/src/ns/a", dir, err)
+	}
+	if calls != 1 {
+		t.Fatalf("Got %d go env calls, expected the result to be cached", calls)
+	}
+
+	// settings in the go env config file apply to unset variables
+	if err := fs.WriteFile("/patsy/goenv", []byte("GOPATH=/patsy/gopath\nGOFLAGS=-tags=patsy\n")); err != nil {
+		t.Fatal(err)
+	}
+	g = patsy.GoEnv(env)
+	if g.GOPATH != "/patsy/gopath" || g.GOFLAGS != "-tags=patsy" {
+		t.Fatalf("Got %+v, expected the settings from the config file", g)
+	}
+	if path, err := patsy.Path(env, "/patsy/gopath/src/ns/b"); err != nil || path != "ns/b" {
+		t.Fatalf("Got %s, %v, expected ns/b", path, err)
+	}
+
+	// the go tool is used when it can be run
+	goenvJSON = `{"GOPATH": "/patsy/other", "GOROOT": "/patsy/goroot"}`
+	if err := env.Setenv("GOFLAGS", "-mod=mod"); err != nil {
+		t.Fatal(err)
+	}
+	g = patsy.GoEnv(env)
+	if g.GOPATH != "/patsy/other" || g.GOROOT != "/patsy/goroot" || g.GOMODCACHE != "/patsy/other/pkg/mod" {
+		t.Fatalf("Got %+v, expected the go env output", g)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module ns\n\ngo 1.12\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "a.go"), []byte("package a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processWd, _ := os.Getwd()
+	processFlags, processFlagsSet := os.LookupEnv("GOFLAGS")
+
+	env := vos.Passthrough()
+	if err := env.Setwd(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setenv("GOFLAGS", "-tags=patsy"); err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	env.Setstdout(stdout)
+
+	dir, err := patsy.Dir(env, "ns/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(root, "a") {
+		t.Fatalf("Got %s, expected %s", dir, filepath.Join(root, "a"))
+	}
+	if err := env.Command(context.Background(), "go", "env", "GOFLAGS").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(stdout.String()) != "-tags=patsy" {
+		t.Fatalf("Got %q, expected -tags=patsy", stdout.String())
+	}
+
+	// the process is unchanged
+	if wd, _ := os.Getwd(); wd != processWd {
+		t.Fatalf("Got %s, expected %s", wd, processWd)
+	}
+	if flags, ok := os.LookupEnv("GOFLAGS"); flags != processFlags || ok != processFlagsSet {
+		t.Fatalf("Got %q, expected %q", flags, processFlags)
+	}
+
+	// the streams of the os Env can be set without affecting the process
+	osEnv := vos.Os()
+	osEnv.Setstderr(stdout)
+	if osEnv.Stderr() != stdout || vos.Os().Stderr() != os.Stderr {
+		t.Fatal("Expected the stderr of the Env to be set")
+	}
+}
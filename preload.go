@@ -0,0 +1,116 @@
+package patsy
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WithPreload preloads the packages matching patterns in the background the
+// first time each working dir is used, and again after its module
+// configuration changes. Lookups are served as usual while the preload runs.
+// Errors are reported to the Observer as a PreloadMethod command.
+func WithPreload(patterns ...string) Option {
+	return func(c *Cache) {
+		if patterns == nil {
+			patterns = []string{}
+		}
+		c.preload = patterns
+	}
+}
+
+// Preload fills the Cache with the dir, path and name of every package
+// matching patterns, resolved from the current working dir, using a single run
+// of `go list`. The default pattern is "./...". Add "all" to also preload
+// dependencies. Packages with errors are skipped, so they are resolved as
+// usual when looked up.
+func (c *Cache) Preload(ctx context.Context, patterns ...string) error {
+	wd, err := c.env.Getwd()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	goenv, sc := c.check(wd)
+	return c.preloadWd(ctx, wd, entryKey{goenv: goenv, wd: sc}, patterns)
+}
+
+// startPreload starts a background preload for the environment and scope in
+// k, unless one has already been started since the module configuration last
+// changed. The patterns are resolved from the scope dir, so by default the
+// whole module is preloaded.
+func (c *Cache) startPreload(k entryKey) {
+	c.modm.Lock()
+	_, started, _ := c.preloaded.get(k)
+	c.preloaded.set(k, true)
+	c.modm.Unlock()
+	if started {
+		return
+	}
+	go func() {
+		_ = c.preloadWd(context.Background(), k.wd, k, c.preload)
+	}()
+}
+
+// unpreload allows background preloads for the scope wd to start again. The
+// caller must hold modm.
+func (c *Cache) unpreload(wd string) {
+	c.preloaded.filter(func(k entryKey, _ interface{}) bool {
+		return k.wd == wd
+	})
+}
+
+// preloadWd preloads the packages matching patterns resolved from dir, into
+// the environment and scope in k.
+func (c *Cache) preloadWd(ctx context.Context, dir string, k entryKey, patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	k.arg = strings.Join(patterns, " ")
+	var packages []Package
+	var err error
+	c.command(PreloadMethod, k, func() error {
+		err = walkPackages(ctx, c.env, dir, patterns, func(p Package) error {
+			packages = append(packages, p)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if envHash(c.env) != k.goenv {
+		// the environment changed while listing, so the results may be
+		// for neither environment
+		return nil
+	}
+	var records []record
+	for _, p := range packages {
+		if p.Err != nil || p.Incomplete || p.Dir == "" {
+			continue
+		}
+		records = append(records, record{Method: PathMethod, Env: k.goenv, Wd: k.wd, Key: p.Dir, Value: p.ImportPath, Dir: p.Dir})
+		if c.nameable(k.wd, p.ImportPath) {
+			records = append(records, record{Method: NameMethod, Env: k.goenv, Wd: k.wd, Key: p.ImportPath, Value: p.Name})
+		}
+	}
+	c.save(records...)
+	return nil
+}
+
+// nameable reports whether the name of the package listed as ppath is also
+// the result of Name(ppath, wd). This is not the case for vendored import
+// paths, or when a vendor dir visible from wd shadows ppath.
+func (c *Cache) nameable(wd, ppath string) bool {
+	if ppath == "vendor" || strings.HasPrefix(ppath, "vendor/") || strings.Contains(ppath, "/vendor/") || strings.HasPrefix(ppath, "_/") {
+		return false
+	}
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := c.env.Stat(filepath.Join(dir, "vendor", filepath.FromSlash(ppath))); err == nil {
+			return false
+		}
+		if filepath.Dir(dir) == dir {
+			return true
+		}
+	}
+}
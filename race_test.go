@@ -0,0 +1,159 @@
+package patsy_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/dave/patsy"
+	"github.com/dave/patsy/builder"
+	"github.com/dave/patsy/vos"
+)
+
+// These tests share an Env between goroutines that change it and goroutines
+// that look packages up with it. Run them with -race.
+
+func TestMockEnvConcurrent(t *testing.T) {
+	for _, gomod := range []bool{true, false} {
+		t.Run(fmt.Sprintf("gomod=%v", gomod), func(t *testing.T) {
+			env := vos.Mock()
+			b, err := builder.New(env, "ns", gomod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Cleanup()
+
+			packagePath, packageDir, err := b.Package("a", map[string]string{"a.go": "package a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wds := []string{b.Root(), packageDir}
+			if err := env.Setwd(b.Root()); err != nil {
+				t.Fatal(err)
+			}
+			c := patsy.NewCache(env)
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			run := func(fn func(i int)) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						fn(i)
+					}
+				}()
+			}
+
+			// change the Env until the lookups are done
+			run(func(i int) {
+				if err := env.Setwd(wds[i%len(wds)]); err != nil {
+					t.Error(err)
+				}
+				if _, err := env.Getwd(); err != nil {
+					t.Error(err)
+				}
+			})
+			run(func(i int) {
+				if err := env.Setenv("PATSY_CONCURRENT", fmt.Sprint(i)); err != nil {
+					t.Error(err)
+				}
+				_ = env.Environ()
+				_, _ = env.LookupEnv("PATSY_CONCURRENT")
+				if i%2 == 0 {
+					_ = env.Unsetenv("PATSY_CONCURRENT")
+				}
+			})
+			run(func(i int) {
+				env.Setstdout(&bytes.Buffer{})
+				env.Setstderr(&bytes.Buffer{})
+				_ = env.Stdout()
+				_ = env.Stderr()
+				_ = env.Stdin()
+			})
+
+			var lookups sync.WaitGroup
+			for n := 0; n < 4; n++ {
+				lookups.Add(1)
+				go func() {
+					defer lookups.Done()
+					for i := 0; i < 5; i++ {
+						if dir, err := patsy.Dir(env, packagePath); err != nil || dir != packageDir {
+							t.Errorf("Dir: got %s, %v, expected %s", dir, err, packageDir)
+						}
+						if ppath, err := patsy.Path(env, packageDir); err != nil || ppath != packagePath {
+							t.Errorf("Path: got %s, %v, expected %s", ppath, err, packagePath)
+						}
+						if name, err := patsy.Name(env, packagePath, b.Root()); err != nil || name != "a" {
+							t.Errorf("Name: got %s, %v, expected a", name, err)
+						}
+						if dir, err := c.Dir(packagePath); err != nil || dir != packageDir {
+							t.Errorf("Cache.Dir: got %s, %v, expected %s", dir, err, packageDir)
+						}
+						if name, err := c.Name(packagePath, b.Root()); err != nil || name != "a" {
+							t.Errorf("Cache.Name: got %s, %v, expected a", name, err)
+						}
+					}
+				}()
+			}
+			lookups.Wait()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestNameConcurrent(t *testing.T) {
+	env := vos.Passthrough()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup()
+
+	packages := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		packagePath, packageDir, err := b.Package(name, map[string]string{name + ".go": "package " + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packages[packagePath] = packageDir
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lookups from different src dirs run at the same time, and leave the
+	// working dir of the process alone
+	var wg sync.WaitGroup
+	for packagePath, packageDir := range packages {
+		wg.Add(1)
+		go func(packagePath, packageDir string) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				name, err := patsy.Name(env, packagePath, packageDir)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if expected := path.Base(packagePath); name != expected {
+					t.Errorf("Got %s, expected %s", name, expected)
+				}
+			}
+		}(packagePath, packageDir)
+	}
+	wg.Wait()
+
+	if calculated, err := os.Getwd(); err != nil || calculated != wd {
+		t.Fatalf("Got %s, %v, expected the working dir to stay %s", calculated, err, wd)
+	}
+}
@@ -0,0 +1,154 @@
+package patsy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/dave/patsy/vos"
+	"github.com/pkg/errors"
+)
+
+// snapshot is the serialized form of a Cache.
+type snapshot struct {
+	Dirs []snapshotDir `json:"dirs"`
+}
+
+// snapshotDir holds the entries cached for a working dir (or a src dir for
+// Name) in any Go environment, and the module configuration files that
+// governed it.
+type snapshotDir struct {
+	Wd      string         `json:"wd"`
+	Files   []snapshotFile `json:"files"` // in fingerprint order
+	Records []record       `json:"records"`
+}
+
+// snapshotFile identifies a module configuration file by its content. Empty
+// means the file did not exist.
+type snapshotFile struct {
+	Path string `json:"path,omitempty"`
+	Sum  string `json:"sum,omitempty"`
+}
+
+// Snapshot returns all entries in the Cache as JSON, along with the working
+// dirs and Go environments they were resolved in, and the module configuration
+// files that governed those dirs. Use LoadCache to restore it,
+// e.g. in a build step without a Go toolchain.
+func (c *Cache) Snapshot() ([]byte, error) {
+	// entries are keyed by scope, apart from lookups relative to a dir,
+	// which are keyed by the dir itself
+	c.modm.Lock()
+	fingerprints := make(map[string]fingerprint)
+	c.dirCache.each(func(k entryKey, v interface{}) {
+		fingerprints[k.wd] = v.(*dirCheck).fp
+	})
+	c.modCache.each(func(k entryKey, v interface{}) {
+		fingerprints[k.wd] = v.(fingerprint)
+	})
+	c.modm.Unlock()
+
+	records := map[string][]record{}
+	for _, method := range []string{DirMethod, DirsMethod, PathMethod, NameMethod} {
+		c.table(method).each(func(k entryKey, v interface{}) {
+			r := record{Method: method, Env: k.goenv, Wd: k.wd, Key: k.arg}
+			if method == DirsMethod {
+				r.Dirs = v.(map[string]string)
+			} else {
+				r.Value = v.(string)
+			}
+			records[k.wd] = append(records[k.wd], r)
+		})
+	}
+
+	var s snapshot
+	for wd, rs := range records {
+		// entries are only valid with the fingerprint of their working dir
+		fp, ok := fingerprints[wd]
+		if !ok {
+			continue
+		}
+		sort.Slice(rs, func(i, j int) bool {
+			if rs[i].Env != rs[j].Env {
+				return rs[i].Env < rs[j].Env
+			}
+			if rs[i].Method != rs[j].Method {
+				return rs[i].Method < rs[j].Method
+			}
+			return rs[i].Key < rs[j].Key
+		})
+		d := snapshotDir{Wd: wd, Records: rs}
+		for _, st := range fp {
+			d.Files = append(d.Files, snapshotStamp(st))
+		}
+		s.Dirs = append(s.Dirs, d)
+	}
+	sort.Slice(s.Dirs, func(i, j int) bool { return s.Dirs[i].Wd < s.Dirs[j].Wd })
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+// LoadCache returns a new *Cache restored from a snapshot produced by
+// Cache.Snapshot. Entries are only restored if the module configuration files
+// governing their working dir still have the same contents, and are only used
+// in the Go environment they were resolved in. Other entries are discarded, so
+// they are resolved as usual when looked up.
+func LoadCache(env vos.Env, r io.Reader, options ...Option) (*Cache, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, errors.Wrap(err, "Error decoding cache snapshot")
+	}
+	c := NewCache(env, options...)
+	// the scopes evicted to make room for others, whose entries can't be
+	// checked (see WithMaxEntries)
+	evicted := map[string]bool{}
+	for _, d := range s.Dirs {
+		fp, _ := refresh(env, fingerprint{}, configFiles(env, d.Wd))
+		if !matchSnapshot(fp, d.Files) {
+			continue
+		}
+		sc := scope(env, d.Wd, fp)
+		c.modm.Lock()
+		for _, item := range c.modCache.set(entryKey{wd: sc}, fp) {
+			evicted[item.key.wd] = true
+		}
+		c.modm.Unlock()
+		delete(evicted, sc)
+		for _, r := range d.Records {
+			if r.Wd != d.Wd {
+				continue
+			}
+			c.apply(r)
+		}
+	}
+	if len(evicted) > 0 {
+		c.forget(filter{wd: func(wd string) bool { return evicted[wd] }})
+	}
+	return c, nil
+}
+
+func snapshotStamp(st stamp) snapshotFile {
+	if st.path == "" {
+		return snapshotFile{}
+	}
+	return snapshotFile{Path: st.path, Sum: hex.EncodeToString(st.sum[:])}
+}
+
+// matchSnapshot reports whether the files in fp have the contents recorded in
+// files. Modification times are ignored, since they are not preserved when
+// files are copied.
+func matchSnapshot(fp fingerprint, files []snapshotFile) bool {
+	if len(files) != len(fp) {
+		return false
+	}
+	for i, st := range fp {
+		if snapshotStamp(st) != files[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package patsy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The names of the cached methods, as reported in events.
+const (
+	DirMethod     = "Dir"
+	DirsMethod    = "Dirs"
+	PathMethod    = "Path"
+	NameMethod    = "Name"
+	PreloadMethod = "Preload" // only reported in command events
+	GoEnvMethod   = "GoEnv"   // only reported in command events
+)
+
+// Stats are the statistics for a Cache.
+type Stats struct {
+	Dir  MethodStats
+	Dirs MethodStats
+	Path MethodStats
+	Name MethodStats
+
+	Preload MethodStats // only Commands, InFlight and Time are counted
+	GoEnv   MethodStats // only Commands, InFlight and Time are counted
+}
+
+// MethodStats are the statistics for a single method of a Cache.
+type MethodStats struct {
+	Hits      int64         // lookups answered by the cache
+	Misses    int64         // lookups not answered by the cache
+	Evictions int64         // entries evicted because the cache was full or they expired
+	InFlight  int64         // lookups currently running the go tool
+	Commands  int64         // completed lookups that ran the go tool
+	Time      time.Duration // total time spent running the go tool
+}
+
+// Observer is notified of every lookup and every external command run by a
+// Cache, so they can be fed into metrics and tracing. Methods may be called
+// concurrently.
+type Observer interface {
+	Lookup(LookupEvent)
+	Command(CommandEvent)
+}
+
+// LookupEvent describes a lookup in a Cache.
+type LookupEvent struct {
+	Method string // DirMethod, DirsMethod, PathMethod or NameMethod
+	Wd     string // the working dir (or the src dir for Name), or its module root or vendor scope
+	Key    string // the package path or dir looked up
+	Hit    bool   // true if the lookup was answered by the cache
+}
+
+// CommandEvent describes an external command run by a Cache after a miss. The
+// go env runs used for GOPATH fallbacks are reported as GoEnvMethod commands,
+// with the working dir and no key. A run during a Path lookup is also counted
+// in the Time of the Path command.
+type CommandEvent struct {
+	Method   string // DirsMethod, PathMethod, NameMethod, PreloadMethod or GoEnvMethod
+	Wd       string // the working dir (or the src dir for Name), or its module root or vendor scope
+	Key      string // the package path or dir looked up (or the patterns for Preload)
+	Duration time.Duration
+	Err      error
+}
+
+// WithObserver notifies o of every lookup and external command.
+func WithObserver(o Observer) Option {
+	return func(c *Cache) {
+		c.observer = o
+	}
+}
+
+// counters are updated atomically.
+type counters struct {
+	hits     int64
+	misses   int64
+	inFlight int64
+	commands int64
+	nanos    int64
+}
+
+// Stats returns the statistics for the Cache.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Dir:  c.methodStats(DirMethod),
+		Dirs: c.methodStats(DirsMethod),
+		Path: c.methodStats(PathMethod),
+		Name: c.methodStats(NameMethod),
+
+		Preload: c.methodStats(PreloadMethod),
+		GoEnv:   c.methodStats(GoEnvMethod),
+	}
+}
+
+func (c *Cache) methodStats(method string) MethodStats {
+	counts := c.counters[method]
+	stats := MethodStats{
+		Hits:     atomic.LoadInt64(&counts.hits),
+		Misses:   atomic.LoadInt64(&counts.misses),
+		InFlight: atomic.LoadInt64(&counts.inFlight),
+		Commands: atomic.LoadInt64(&counts.commands),
+		Time:     time.Duration(atomic.LoadInt64(&counts.nanos)),
+	}
+	if t := c.table(method); t != nil {
+		stats.Evictions = t.evictions()
+	}
+	return stats
+}
+
+// lookup records a lookup, and notifies the observer.
+func (c *Cache) lookup(method string, k entryKey, hit bool) {
+	if hit {
+		atomic.AddInt64(&c.counters[method].hits, 1)
+	} else {
+		atomic.AddInt64(&c.counters[method].misses, 1)
+	}
+	if c.observer != nil {
+		c.observer.Lookup(LookupEvent{Method: method, Wd: k.wd, Key: k.arg, Hit: hit})
+	}
+}
+
+// command runs fn, which runs an external command, recording the time it takes
+// and notifying the observer.
+func (c *Cache) command(method string, k entryKey, fn func() error) {
+	counts := c.counters[method]
+	atomic.AddInt64(&counts.inFlight, 1)
+	start := time.Now()
+	err := fn()
+	duration := time.Since(start)
+	atomic.AddInt64(&counts.inFlight, -1)
+	atomic.AddInt64(&counts.commands, 1)
+	atomic.AddInt64(&counts.nanos, int64(duration))
+	if c.observer != nil {
+		c.observer.Command(CommandEvent{Method: method, Wd: k.wd, Key: k.arg, Duration: duration, Err: err})
+	}
+}
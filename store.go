@@ -0,0 +1,211 @@
+package patsy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// record is the result of a single lookup, in a form that can be serialized.
+type record struct {
+	Method string            `json:"method"`
+	Env    string            `json:"env,omitempty"` // hash of the Go environment
+	Wd     string            `json:"wd"`
+	Key    string            `json:"key"`
+	Value  string            `json:"value,omitempty"`
+	Dir    string            `json:"dir,omitempty"`  // for Path, the dir with symlinks evaluated
+	Dirs   map[string]string `json:"dirs,omitempty"` // for Dirs
+
+	Saved   int64 `json:"saved,omitempty"`   // when the record was stored, in Unix nanoseconds
+	Deleted bool  `json:"deleted,omitempty"` // removes the stored record for the same lookup
+}
+
+// value returns the result of the lookup.
+func (r record) value() interface{} {
+	if r.Method == DirsMethod {
+		return r.Dirs
+	}
+	return r.Value
+}
+
+// Store is a persistent on-disk backing store for a Cache, allowing results to
+// be shared across process invocations. Results are stored in a file per module
+// root, named with a hash of the module root, the module configuration files
+// and the Go environment, so they are invalidated automatically when any of
+// these change. Results are appended to the file as they are resolved, and the
+// file is compacted when it is loaded if it holds many replaced results. Files
+// are locked while they are read and written, so a Store can be shared by
+// several processes.
+//
+// Stored results expire with the TTL of the Cache (see WithTTL), and results
+// for package dirs that no longer exist are not loaded. Results discarded by
+// Forget, ForgetPrefix, ForgetDir, ForgetWorkingDir and Watch are also removed
+// from the Store.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a Store that keeps its files in dir, creating dir if
+// needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "Error creating store dir")
+	}
+	return &Store{dir: dir}, nil
+}
+
+// DefaultStore returns a Store in the patsy dir of the user cache dir.
+func DefaultStore() (*Store, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewStore(filepath.Join(dir, "patsy"))
+}
+
+// Clear deletes all results in the Store.
+func (s *Store) Clear() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			if err := os.Remove(filepath.Join(s.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// read returns the records in the file for key. If the file holds more
+// replaced or corrupt records than current ones, it is compacted.
+func (s *Store) read(key string) ([]record, error) {
+	unlock, err := lockFile(s.path(key) + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	records, stale, err := s.readLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if stale > len(records) {
+		// the records are still valid if the file can't be compacted
+		_ = s.compactLocked(key, records)
+	}
+	return records, nil
+}
+
+// write appends records to the file for key. They replace any records for the
+// same lookups when the file is read.
+func (s *Store) write(key string, records []record) error {
+	b, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(s.path(key) + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(s.path(key), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// readLocked returns the current records in the file for key, and the number
+// of records that were replaced or deleted by later ones, or could not be
+// decoded.
+func (s *Store) readLocked(key string) (records []record, stale int, err error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	type lookup struct{ method, wd, key string }
+	var all []record
+	latest := map[lookup]int{} // the index in all of the last record for each lookup
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			// a corrupt record, e.g. from an interrupted write, is skipped
+			// and removed when the file is compacted
+			stale++
+			continue
+		}
+		latest[lookup{r.Method, r.Wd, r.Key}] = len(all)
+		all = append(all, r)
+	}
+	for i, r := range all {
+		if latest[lookup{r.Method, r.Wd, r.Key}] != i || r.Deleted {
+			stale++
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, stale, nil
+}
+
+// compactLocked replaces the file for key with records.
+func (s *Store) compactLocked(key string, records []record) error {
+	b, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename, so readers that don't take the
+	// lock never see a partial file
+	f, err := ioutil.TempFile(s.dir, key+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(f.Name(), s.path(key)); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// encodeRecords encodes records one per line.
+func encodeRecords(records []record) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
@@ -0,0 +1,197 @@
+// Package exec runs external commands for vos.Env. A Cmd either starts a real
+// process, or calls a Handler that fakes the program in the same process.
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Handler fakes a program. It is called with a copy of the Cmd, whose Stdin,
+// Stdout and Stderr are never nil, and should return when ctx is done. Return
+// an *ExitError to report a non-zero exit code.
+type Handler func(ctx context.Context, cmd *Cmd) error
+
+// ExitError is returned by Wait, Run, Output and CombinedOutput when a
+// Handler reports a non-zero exit code. Real processes return an
+// *os/exec.ExitError.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Cmd is similar to os/exec.Cmd. Unlike os/exec.Cmd, Output, CombinedOutput
+// and StdoutPipe replace Stdout (and Stderr for CombinedOutput), so they can
+// be used with a Cmd that was created with streams already set.
+type Cmd struct {
+	// Path is the name of the program, and Args holds the command line
+	// arguments, including the program name as Args[0].
+	Path string
+	Args []string
+
+	// Dir is the working dir of the command. If empty the command runs in the
+	// working dir of the calling process.
+	Dir string
+
+	// Env is the environment of the command in the form "key=value". If nil
+	// the command uses the environment of the calling process.
+	Env []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ctx     context.Context
+	handler Handler
+	cmd     *exec.Cmd      // the real process, if there is no handler
+	pipe    *io.PipeWriter // the handler end of StdoutPipe
+	done    chan error     // receives the result of the handler
+	started bool
+}
+
+// Command returns a Cmd that runs the named program as a real process. The
+// process is killed if ctx is done before it exits.
+func Command(ctx context.Context, name string, args ...string) *Cmd {
+	return &Cmd{
+		Path: name,
+		Args: append([]string{name}, args...),
+		ctx:  ctx,
+		cmd:  exec.CommandContext(ctx, name, args...),
+	}
+}
+
+// Handled returns a Cmd that calls h instead of running the named program.
+func Handled(ctx context.Context, h Handler, name string, args ...string) *Cmd {
+	return &Cmd{
+		Path:    name,
+		Args:    append([]string{name}, args...),
+		ctx:     ctx,
+		handler: h,
+	}
+}
+
+// String returns the command line.
+func (c *Cmd) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Start starts the command but does not wait for it to complete.
+func (c *Cmd) Start() error {
+	if c.started {
+		return errors.New("exec: already started")
+	}
+	c.started = true
+
+	if c.handler == nil {
+		c.cmd.Dir = c.Dir
+		c.cmd.Env = c.Env
+		c.cmd.Stdin = c.Stdin
+		c.cmd.Stderr = c.Stderr
+		if c.cmd.Stdout == nil {
+			c.cmd.Stdout = c.Stdout
+		}
+		return c.cmd.Start()
+	}
+
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	h := *c
+	if h.Stdin == nil {
+		h.Stdin = bytes.NewReader(nil)
+	}
+	if c.pipe != nil {
+		h.Stdout = c.pipe
+	}
+	if h.Stdout == nil {
+		h.Stdout = ioutil.Discard
+	}
+	if h.Stderr == nil {
+		h.Stderr = ioutil.Discard
+	}
+	c.done = make(chan error, 1)
+	go func() {
+		err := c.handler(c.ctx, &h)
+		if c.pipe != nil {
+			// closing the pipe is the end of the output, as when a process
+			// exits
+			_ = c.pipe.Close()
+		}
+		c.done <- err
+	}()
+	return nil
+}
+
+// Wait waits for the command to exit. If ctx is done first, the output pipe
+// of a faked program is closed so its writes fail, and the error from ctx is
+// returned once the handler has returned.
+func (c *Cmd) Wait() error {
+	if !c.started {
+		return errors.New("exec: not started")
+	}
+	if c.handler == nil {
+		return c.cmd.Wait()
+	}
+	select {
+	case err := <-c.done:
+		return err
+	case <-c.ctx.Done():
+		if c.pipe != nil {
+			_ = c.pipe.CloseWithError(c.ctx.Err())
+		}
+		<-c.done
+		return c.ctx.Err()
+	}
+}
+
+// Run starts the command and waits for it to complete.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the command and returns its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	err := c.Run()
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// standard error combined.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// StdoutPipe returns a pipe connected to the standard output of the command
+// when it starts. The pipe is closed when the command exits, so reads return
+// io.EOF once all the output has been read.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.started {
+		return nil, errors.New("exec: StdoutPipe after process started")
+	}
+	c.Stdout = nil
+	if c.handler == nil {
+		c.cmd.Stdout = nil
+		return c.cmd.StdoutPipe()
+	}
+	r, w := io.Pipe()
+	c.pipe = w
+	return r, nil
+}
@@ -0,0 +1,239 @@
+package vos
+
+import (
+	"context"
+	"io"
+	stdos "os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/internal/envstr"
+)
+
+// Fork returns a child of env. The child starts with the variables, working
+// dir and streams of env, and sees later changes to env until it sets its own.
+// Changes to the child don't affect env. The filesystem and commands are
+// those of env, with relative paths resolved from the working dir of the
+// child.
+func Fork(env Env) Env {
+	return &fork{
+		parent: env,
+		vars:   make(map[string]string),
+		unset:  make(map[string]bool),
+	}
+}
+
+// Overlay returns a child of env, as Fork does, with vars set.
+func Overlay(env Env, vars map[string]string) (Env, error) {
+	child := Fork(env)
+	for k, v := range vars {
+		if err := child.Setenv(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return child, nil
+}
+
+type fork struct {
+	parent Env
+	m      sync.RWMutex
+	vars   map[string]string // variables set in the child
+	unset  map[string]bool   // variables removed in the child
+	clear  bool              // whether Clearenv has been called on the child
+	wd     string            // empty until set in the child
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
+
+func (f *fork) Environ() []string {
+	parent := f.parent.Environ()
+	f.m.RLock()
+	merged := make(map[string]string)
+	if !f.clear {
+		for _, kv := range parent {
+			k, v := envstr.Split(kv)
+			if !f.unset[k] {
+				merged[k] = v
+			}
+		}
+	}
+	for k, v := range f.vars {
+		merged[k] = v
+	}
+	f.m.RUnlock()
+	environ := make([]string, 0, len(merged))
+	for k, v := range merged {
+		environ = append(environ, k+"="+v)
+	}
+	envstr.Sort(environ)
+	return environ
+}
+
+func (f *fork) Getenv(key string) string {
+	v, _ := f.LookupEnv(key)
+	return v
+}
+
+func (f *fork) LookupEnv(key string) (string, bool) {
+	f.m.RLock()
+	if v, ok := f.vars[key]; ok {
+		f.m.RUnlock()
+		return v, true
+	}
+	hidden := f.clear || f.unset[key]
+	f.m.RUnlock()
+	if hidden {
+		return "", false
+	}
+	return f.parent.LookupEnv(key)
+}
+
+func (f *fork) Setenv(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\x00") || strings.Contains(value, "\x00") {
+		return stdos.NewSyscallError("setenv", syscall.EINVAL)
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.vars[key] = value
+	delete(f.unset, key)
+	return nil
+}
+
+func (f *fork) Unsetenv(key string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	delete(f.vars, key)
+	f.unset[key] = true
+	return nil
+}
+
+func (f *fork) Clearenv() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.vars = make(map[string]string)
+	f.unset = make(map[string]bool)
+	f.clear = true
+}
+
+func (f *fork) Getwd() (string, error) {
+	f.m.RLock()
+	wd := f.wd
+	f.m.RUnlock()
+	if wd == "" {
+		return f.parent.Getwd()
+	}
+	return wd, nil
+}
+
+func (f *fork) Setwd(dir string) error {
+	dir, err := f.Abs(dir)
+	if err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.wd = dir
+	return nil
+}
+
+func (f *fork) Stdout() io.Writer {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if f.stdout != nil {
+		return f.stdout
+	}
+	return f.parent.Stdout()
+}
+
+func (f *fork) Setstdout(w io.Writer) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.stdout = w
+}
+
+func (f *fork) Stderr() io.Writer {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if f.stderr != nil {
+		return f.stderr
+	}
+	return f.parent.Stderr()
+}
+
+func (f *fork) Setstderr(w io.Writer) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.stderr = w
+}
+
+func (f *fork) Stdin() io.Reader {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if f.stdin != nil {
+		return f.stdin
+	}
+	return f.parent.Stdin()
+}
+
+func (f *fork) Setstdin(r io.Reader) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.stdin = r
+}
+
+func (f *fork) Stat(name string) (stdos.FileInfo, error) {
+	return f.parent.Stat(f.path(name))
+}
+
+func (f *fork) Lstat(name string) (stdos.FileInfo, error) {
+	return f.parent.Lstat(f.path(name))
+}
+
+func (f *fork) ReadDir(dirname string) ([]stdos.FileInfo, error) {
+	return f.parent.ReadDir(f.path(dirname))
+}
+
+func (f *fork) ReadFile(filename string) ([]byte, error) {
+	return f.parent.ReadFile(f.path(filename))
+}
+
+func (f *fork) EvalSymlinks(path string) (string, error) {
+	return f.parent.EvalSymlinks(f.path(path))
+}
+
+func (f *fork) Abs(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	wd, err := f.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, path), nil
+}
+
+func (f *fork) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := f.parent.Command(ctx, name, args...)
+	cmd.Dir, _ = f.Getwd()
+	cmd.Env = f.Environ()
+	cmd.Stdin = f.Stdin()
+	cmd.Stdout = f.Stdout()
+	cmd.Stderr = f.Stderr()
+	return cmd
+}
+
+// path returns name resolved from the working dir of the child, if it is
+// relative and the child has its own working dir.
+func (f *fork) path(name string) string {
+	f.m.RLock()
+	wd := f.wd
+	f.m.RUnlock()
+	if wd == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(wd, name)
+}
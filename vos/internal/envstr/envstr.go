@@ -0,0 +1,31 @@
+// Package envstr handles environment strings, in the form "key=value", for
+// the vos packages.
+package envstr
+
+import (
+	"sort"
+	"strings"
+)
+
+// Split splits an environment string into key and value at the first "=".
+// On Windows keys can start with "=", so the search starts after the first
+// character.
+func Split(kv string) (key, value string) {
+	var start int
+	if strings.HasPrefix(kv, "=") {
+		start = 1
+	}
+	if i := strings.Index(kv[start:], "="); i >= 0 {
+		return kv[:start+i], kv[start+i+1:]
+	}
+	return kv, ""
+}
+
+// Sort sorts environment strings by key.
+func Sort(environ []string) {
+	sort.Slice(environ, func(i, j int) bool {
+		ki, _ := Split(environ[i])
+		kj, _ := Split(environ[j])
+		return ki < kj
+	})
+}
@@ -0,0 +1,288 @@
+package mock
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxLinks is the number of symlinks followed before giving up, as in most
+// operating systems.
+const maxLinks = 255
+
+// FS is an in-memory file tree of directories, files and symlinks. Paths must
+// be absolute. FS is safe for concurrent use.
+type FS struct {
+	m    sync.RWMutex
+	root *node
+}
+
+type node struct {
+	mode     os.FileMode
+	mod      time.Time
+	data     []byte           // for files
+	target   string           // for symlinks
+	children map[string]*node // for dirs
+}
+
+// NewFS returns an FS containing only the root dir.
+func NewFS() *FS {
+	return &FS{root: newDir()}
+}
+
+func newDir() *node {
+	return &node{mode: os.ModeDir | 0755, mod: time.Now(), children: make(map[string]*node)}
+}
+
+// MkdirAll creates a dir and any parents that don't exist.
+func (fs *FS) MkdirAll(name string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	return fs.mkdirAll(name)
+}
+
+func (fs *FS) mkdirAll(name string) error {
+	name = filepath.Clean(name)
+	if _, n, err := fs.lookup("mkdir", name, true, 0); err == nil {
+		if !n.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := fs.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	return fs.create("mkdir", name, newDir())
+}
+
+// WriteFile writes data to a file, creating it if needed. The parent dir must
+// exist.
+func (fs *FS) WriteFile(name string, data []byte) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	if _, n, err := fs.lookup("open", name, true, 0); err == nil {
+		if n.mode.IsDir() {
+			return &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		n.data = append([]byte(nil), data...)
+		n.mod = time.Now()
+		return nil
+	}
+	return fs.create("open", name, &node{mode: 0644, mod: time.Now(), data: append([]byte(nil), data...)})
+}
+
+// Symlink creates newname as a symlink to oldname. The parent dir of newname
+// must exist.
+func (fs *FS) Symlink(oldname, newname string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	return fs.create("symlink", newname, &node{mode: os.ModeSymlink | 0777, mod: time.Now(), target: oldname})
+}
+
+// Chtimes sets the modification time of a file or dir.
+func (fs *FS) Chtimes(name string, mtime time.Time) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	_, n, err := fs.lookup("chtimes", name, true, 0)
+	if err != nil {
+		return err
+	}
+	n.mod = mtime
+	return nil
+}
+
+// Remove removes a file, symlink or empty dir.
+func (fs *FS) Remove(name string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	parent, base, err := fs.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	n, ok := parent.children[base]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() && len(n.children) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(parent.children, base)
+	parent.mod = time.Now()
+	return nil
+}
+
+// RemoveAll removes a file, symlink or dir and everything it contains. It
+// returns nil if name doesn't exist.
+func (fs *FS) RemoveAll(name string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	parent, base, err := fs.parent("remove", name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := parent.children[base]; ok {
+		delete(parent.children, base)
+		parent.mod = time.Now()
+	}
+	return nil
+}
+
+// Stat returns the FileInfo for a file or dir, following symlinks.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.m.RLock()
+	defer fs.m.RUnlock()
+	_, n, err := fs.lookup("stat", name, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	return info(filepath.Base(name), n), nil
+}
+
+// Lstat returns the FileInfo for a file, dir or symlink, without following a
+// final symlink.
+func (fs *FS) Lstat(name string) (os.FileInfo, error) {
+	fs.m.RLock()
+	defer fs.m.RUnlock()
+	_, n, err := fs.lookup("lstat", name, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return info(filepath.Base(name), n), nil
+}
+
+// ReadDir returns the FileInfo for each entry in a dir, sorted by name.
+func (fs *FS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.m.RLock()
+	defer fs.m.RUnlock()
+	_, n, err := fs.lookup("open", dirname, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: dirname, Err: syscall.ENOTDIR}
+	}
+	infos := make([]os.FileInfo, 0, len(n.children))
+	for name, child := range n.children {
+		infos = append(infos, info(name, child))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// ReadFile returns the contents of a file.
+func (fs *FS) ReadFile(filename string) ([]byte, error) {
+	fs.m.RLock()
+	defer fs.m.RUnlock()
+	_, n, err := fs.lookup("open", filename, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: filename, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+// EvalSymlinks returns the path after following all symlinks.
+func (fs *FS) EvalSymlinks(path string) (string, error) {
+	fs.m.RLock()
+	defer fs.m.RUnlock()
+	real, _, err := fs.lookup("lstat", path, true, 0)
+	return real, err
+}
+
+// lookup finds the node for name, following symlinks in all but the final
+// element, and in the final element too if follow is true. It returns the
+// path of the node with symlinks evaluated.
+func (fs *FS) lookup(op, name string, follow bool, links int) (string, *node, error) {
+	name = filepath.Clean(name)
+	if !filepath.IsAbs(name) {
+		return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	root := filepath.VolumeName(name) + string(filepath.Separator)
+	var parts []string
+	if rest := strings.TrimPrefix(name[len(filepath.VolumeName(name)):], string(filepath.Separator)); rest != "" {
+		parts = strings.Split(rest, string(filepath.Separator))
+	}
+	cur, n := root, fs.root
+	for i, part := range parts {
+		if !n.mode.IsDir() {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		next := filepath.Join(cur, part)
+		if child.mode&os.ModeSymlink != 0 && (follow || i < len(parts)-1) {
+			if links >= maxLinks {
+				return "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := child.target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(cur, target)
+			}
+			var err error
+			if next, child, err = fs.lookup(op, target, true, links+1); err != nil {
+				return "", nil, err
+			}
+		}
+		cur, n = next, child
+	}
+	return cur, n, nil
+}
+
+// parent returns the dir containing name, and the final element of name.
+func (fs *FS) parent(op, name string) (*node, string, error) {
+	name = filepath.Clean(name)
+	_, parent, err := fs.lookup(op, filepath.Dir(name), true, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.mode.IsDir() {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return parent, filepath.Base(name), nil
+}
+
+// create adds n to the dir containing name, which must not already exist.
+func (fs *FS) create(op, name string, n *node) error {
+	parent, base, err := fs.parent(op, name)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.children[base]; ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	parent.children[base] = n
+	parent.mod = n.mod
+	return nil
+}
+
+// fileInfo implements os.FileInfo for a node.
+type fileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+	mod  time.Time
+}
+
+func info(name string, n *node) os.FileInfo {
+	return &fileInfo{name: name, size: int64(len(n.data)), mode: n.mode, mod: n.mod}
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.mod }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() interface{}   { return nil }
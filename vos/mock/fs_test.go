@@ -0,0 +1,186 @@
+package mock
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// errno returns the syscall error wrapped by a PathError, or err itself.
+func errno(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
+
+func newTestFS(t *testing.T) *FS {
+	fs := NewFS()
+	if err := fs.MkdirAll("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/a/b/c.txt", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestRemove(t *testing.T) {
+	fs := newTestFS(t)
+	if err := fs.Remove("/a/b"); errno(err) != syscall.ENOTEMPTY {
+		t.Fatalf("Got %v, expected ENOTEMPTY", err)
+	}
+	if err := fs.Remove("/a/b/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a/b"); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, expected not exist", err)
+	}
+	if err := fs.Remove("/a/b"); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, expected not exist", err)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs := newTestFS(t)
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a/b/c.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, expected not exist", err)
+	}
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatalf("Got %v, expected nil for a missing path", err)
+	}
+	if err := fs.RemoveAll("/x/y/z"); err != nil {
+		t.Fatalf("Got %v, expected nil for a missing parent", err)
+	}
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("Got %d entries in /, expected none", len(infos))
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	fs := newTestFS(t)
+	if err := fs.Symlink("/a/y", "/a/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("/a/x", "/a/y"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a/x"); errno(err) != syscall.ELOOP {
+		t.Fatalf("Got %v, expected ELOOP", err)
+	}
+	if _, err := fs.ReadFile("/a/x/c.txt"); errno(err) != syscall.ELOOP {
+		t.Fatalf("Got %v, expected ELOOP", err)
+	}
+	if _, err := fs.EvalSymlinks("/a/y"); errno(err) != syscall.ELOOP {
+		t.Fatalf("Got %v, expected ELOOP", err)
+	}
+	info, err := fs.Lstat("/a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("Got mode %v, expected a symlink", info.Mode())
+	}
+}
+
+func TestNotDir(t *testing.T) {
+	fs := newTestFS(t)
+	if _, err := fs.Stat("/a/b/c.txt/d"); errno(err) != syscall.ENOTDIR {
+		t.Fatalf("Got %v, expected ENOTDIR", err)
+	}
+	if err := fs.WriteFile("/a/b/c.txt/d", nil); errno(err) != syscall.ENOTDIR {
+		t.Fatalf("Got %v, expected ENOTDIR", err)
+	}
+	if err := fs.MkdirAll("/a/b/c.txt/d"); errno(err) != syscall.ENOTDIR {
+		t.Fatalf("Got %v, expected ENOTDIR", err)
+	}
+	if _, err := fs.ReadDir("/a/b/c.txt"); errno(err) != syscall.ENOTDIR {
+		t.Fatalf("Got %v, expected ENOTDIR", err)
+	}
+}
+
+func TestSymlinkRelative(t *testing.T) {
+	fs := newTestFS(t)
+	if err := fs.MkdirAll("/d"); err != nil {
+		t.Fatal(err)
+	}
+	// Relative targets resolve from the dir containing the link.
+	if err := fs.Symlink("../a/b", "/d/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("c.txt", "/a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile("/d/link/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "c" {
+		t.Fatalf("Got %q, expected %q", b, "c")
+	}
+	info, err := fs.Stat("/d/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Fatalf("Got mode %v, expected a dir", info.Mode())
+	}
+	real, err := fs.EvalSymlinks("/d/link/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real != "/a/b/c.txt" {
+		t.Fatalf("Got %s, expected /a/b/c.txt", real)
+	}
+	if err := fs.Symlink("missing", "/d/dangling"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/d/dangling"); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, expected not exist", err)
+	}
+}
+
+func TestChtimes(t *testing.T) {
+	fs := newTestFS(t)
+	mtime := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"/a/b/c.txt", "/a/b"} {
+		if err := fs.Chtimes(name, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("Got %v for %s, expected %v", info.ModTime(), name, mtime)
+		}
+	}
+	if err := fs.Symlink("/a/b/c.txt", "/a/link"); err != nil {
+		t.Fatal(err)
+	}
+	later := mtime.Add(time.Hour)
+	if err := fs.Chtimes("/a/link", later); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(later) {
+		t.Fatalf("Got %v, expected Chtimes to follow the link to %v", info.ModTime(), later)
+	}
+	if err := fs.Chtimes("/a/missing", mtime); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, expected not exist", err)
+	}
+}
@@ -1,30 +1,72 @@
 package mock
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/internal/envstr"
 )
 
 func New() *Env {
 	return &Env{
-		varsm: new(sync.RWMutex),
-		vars:  make(map[string]string),
+		varsm:  new(sync.RWMutex),
+		vars:   make(map[string]string),
+		unset:  make(map[string]bool),
+		cmdm:   new(sync.RWMutex),
+		cmds:   make(map[string]exec.Handler),
+		statem: new(sync.RWMutex),
 	}
 }
 
+// NewStrict returns a hermetic Env that never falls through to the real OS
+// for variables or the working dir. The environment starts with only vars,
+// and the working dir must be set with Setwd before Getwd, relative paths or
+// commands are used. Lookups of variables that aren't set are reported by
+// Missing, so tests can audit which variables the code under test reads.
+func NewStrict(vars map[string]string) *Env {
+	e := New()
+	e.clear = true
+	e.strict = true
+	e.missing = make(map[string]bool)
+	for k, v := range vars {
+		e.vars[k] = v
+	}
+	return e
+}
+
+// ErrNoWd is returned by the Getwd of a strict Env when the working dir has
+// not been set.
+var ErrNoWd = errors.New("mock: working dir not set")
+
 type Env struct {
-	varsm  *sync.RWMutex
-	vars   map[string]string
-	wd     string
-	stdout io.Writer
-	stderr io.Writer
-	stdin  io.Reader
+	varsm   *sync.RWMutex
+	vars    map[string]string // variables set with Setenv
+	unset   map[string]bool   // variables removed with Unsetenv
+	clear   bool              // whether Clearenv has been called
+	strict  bool              // whether the Env was created by NewStrict
+	missing map[string]bool   // unset variables looked up in a strict Env
+	cmdm    *sync.RWMutex
+	cmds    map[string]exec.Handler
+	statem  *sync.RWMutex // guards wd, fs and the streams
+	wd      string
+	fs      *FS
+	stdout  io.Writer
+	stderr  io.Writer
+	stdin   io.Reader
 }
 
 func (e *Env) Stdout() io.Writer {
+	e.statem.RLock()
+	defer e.statem.RUnlock()
 	if e.stdout != nil {
 		return e.stdout
 	}
@@ -32,10 +74,14 @@ func (e *Env) Stdout() io.Writer {
 }
 
 func (e *Env) Setstdout(w io.Writer) {
+	e.statem.Lock()
+	defer e.statem.Unlock()
 	e.stdout = w
 }
 
 func (e *Env) Stderr() io.Writer {
+	e.statem.RLock()
+	defer e.statem.RUnlock()
 	if e.stderr != nil {
 		return e.stderr
 	}
@@ -43,10 +89,14 @@ func (e *Env) Stderr() io.Writer {
 }
 
 func (e *Env) Setstderr(w io.Writer) {
+	e.statem.Lock()
+	defer e.statem.Unlock()
 	e.stderr = w
 }
 
 func (e *Env) Stdin() io.Reader {
+	e.statem.RLock()
+	defer e.statem.RUnlock()
 	if e.stdin != nil {
 		return e.stdin
 	}
@@ -54,75 +104,285 @@ func (e *Env) Stdin() io.Reader {
 }
 
 func (e *Env) Setstdin(r io.Reader) {
+	e.statem.Lock()
+	defer e.statem.Unlock()
 	e.stdin = r
 }
 
 func (e *Env) Getenv(key string) string {
-	if e.vars == nil {
-		return os.Getenv(key)
-	}
-	v, ok := e.getVar(key)
-	if !ok {
-		return os.Getenv(key)
-	}
+	v, _ := e.LookupEnv(key)
 	return v
 }
 
+// LookupEnv returns the mocked value of a variable if it has been set, or the
+// value from the system unless it has been removed with Unsetenv or Clearenv.
+func (e *Env) LookupEnv(key string) (string, bool) {
+	if e.varsm == nil {
+		return os.LookupEnv(key)
+	}
+	return e.lookupVar(key)
+}
+
+// Setenv sets a mocked variable, which shadows the value from the system. As
+// with os.Setenv, the key must not be empty or contain "=" or NUL.
 func (e *Env) Setenv(key, value string) error {
-	e.setVar(key, value)
+	if key == "" || strings.ContainsAny(key, "=\x00") || strings.Contains(value, "\x00") {
+		return os.NewSyscallError("setenv", syscall.EINVAL)
+	}
+	e.varsm.Lock()
+	defer e.varsm.Unlock()
+	e.vars[key] = value
+	delete(e.unset, key)
+	return nil
+}
+
+// Unsetenv removes a mocked variable, and hides the value from the system.
+func (e *Env) Unsetenv(key string) error {
+	e.varsm.Lock()
+	defer e.varsm.Unlock()
+	delete(e.vars, key)
+	e.unset[key] = true
 	return nil
 }
 
+// Clearenv removes all mocked variables, and hides all the values from the
+// system.
+func (e *Env) Clearenv() {
+	e.varsm.Lock()
+	defer e.varsm.Unlock()
+	e.vars = make(map[string]string)
+	e.unset = make(map[string]bool)
+	e.clear = true
+}
+
 func (e *Env) Getwd() (string, error) {
-	if e.wd == "" {
+	e.statem.RLock()
+	wd := e.wd
+	e.statem.RUnlock()
+	if wd == "" {
+		if e.strict {
+			return "", ErrNoWd
+		}
 		return os.Getwd()
 	}
-	return e.wd, nil
+	return wd, nil
 }
 
 func (e *Env) Setwd(dir string) error {
+	e.statem.Lock()
+	defer e.statem.Unlock()
 	e.wd = dir
 	return nil
 }
 
-// Environ returns a copy of strings representing the environment, in the form "key=value".
+// Environ returns a copy of strings representing the environment, in the form
+// "key=value", sorted by key.
 func (e *Env) Environ() []string {
-	if len(e.vars) == 0 {
-		return os.Environ()
-	}
-	var out []string
-	merged := make(map[string]string)
-	for _, e := range os.Environ() {
-		// Add the environment variables from the system
-		parts := strings.Split(e, "=")
-		merged[parts[0]] = parts[1]
+	if e.varsm == nil {
+		environ := os.Environ()
+		envstr.Sort(environ)
+		return environ
 	}
-	// Overwrite with the mocked environment variables
-	e.writeVars(merged)
+	merged := e.mergeVars(os.Environ())
+	out := make([]string, 0, len(merged))
 	for k, v := range merged {
 		// Join them back together in Environ syntax
-		out = append(out, fmt.Sprintf("%s=%s", k, v))
+		out = append(out, k+"="+v)
 	}
+	envstr.Sort(out)
 	return out
 }
 
-func (e *Env) getVar(key string) (string, bool) {
+// Handle registers h to fake the named program in commands created by
+// Command. A program is matched by its name, or by its base name if it is run
+// by path. Set nil to run the real program again.
+func (e *Env) Handle(name string, h exec.Handler) {
+	e.cmdm.Lock()
+	defer e.cmdm.Unlock()
+	if h == nil {
+		delete(e.cmds, name)
+		return
+	}
+	e.cmds[name] = h
+}
+
+// Command returns a command that runs in the mocked working dir, with the
+// mocked variables and streams. If a Handler is registered for the program it
+// is called instead of running the program.
+func (e *Env) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if h := e.handler(name); h != nil {
+		cmd = exec.Handled(ctx, h, name, args...)
+	} else {
+		cmd = exec.Command(ctx, name, args...)
+	}
+	wd, err := e.Getwd()
+	if err != nil {
+		// don't run the command in the working dir of the process
+		cmd = exec.Handled(ctx, func(context.Context, *exec.Cmd) error { return err }, name, args...)
+	}
+	cmd.Dir = wd
+	cmd.Env = e.Environ()
+	cmd.Stdin = e.Stdin()
+	cmd.Stdout = e.Stdout()
+	cmd.Stderr = e.Stderr()
+	return cmd
+}
+
+func (e *Env) handler(name string) exec.Handler {
+	if e.cmdm == nil {
+		return nil
+	}
+	e.cmdm.RLock()
+	defer e.cmdm.RUnlock()
+	if h, ok := e.cmds[name]; ok {
+		return h
+	}
+	return e.cmds[filepath.Base(name)]
+}
+
+// SetFS makes the filesystem methods use the in-memory file tree fs instead of
+// the real filesystem. Set nil to use the real filesystem again.
+func (e *Env) SetFS(fs *FS) {
+	e.statem.Lock()
+	defer e.statem.Unlock()
+	e.fs = fs
+}
+
+// FS returns the in-memory file tree set by SetFS, or nil if the real
+// filesystem is used.
+func (e *Env) FS() *FS {
+	e.statem.RLock()
+	defer e.statem.RUnlock()
+	return e.fs
+}
+
+// Unless SetFS is used the filesystem is not mocked, but relative paths are
+// resolved from the mocked working dir.
+
+func (e *Env) Stat(name string) (os.FileInfo, error) {
+	name, err := e.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs := e.FS(); fs != nil {
+		return fs.Stat(name)
+	}
+	return os.Stat(name)
+}
+
+func (e *Env) Lstat(name string) (os.FileInfo, error) {
+	name, err := e.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs := e.FS(); fs != nil {
+		return fs.Lstat(name)
+	}
+	return os.Lstat(name)
+}
+
+func (e *Env) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname, err := e.resolve(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if fs := e.FS(); fs != nil {
+		return fs.ReadDir(dirname)
+	}
+	return ioutil.ReadDir(dirname)
+}
+
+func (e *Env) ReadFile(filename string) ([]byte, error) {
+	filename, err := e.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fs := e.FS(); fs != nil {
+		return fs.ReadFile(filename)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+func (e *Env) EvalSymlinks(path string) (string, error) {
+	path, err := e.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	if fs := e.FS(); fs != nil {
+		return fs.EvalSymlinks(path)
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+func (e *Env) Abs(path string) (string, error) {
+	path, err := e.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(path), nil
+}
+
+// resolve returns name resolved from the working dir, if it is relative.
+func (e *Env) resolve(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	wd, err := e.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, name), nil
+}
+
+// Missing returns the variables that have been looked up in a strict Env
+// without being set, sorted.
+func (e *Env) Missing() []string {
 	e.varsm.RLock()
 	defer e.varsm.RUnlock()
-	v, ok := e.vars[key]
-	return v, ok
+	missing := make([]string, 0, len(e.missing))
+	for k := range e.missing {
+		missing = append(missing, k)
+	}
+	sort.Strings(missing)
+	return missing
 }
 
-func (e *Env) setVar(key, value string) {
-	e.varsm.Lock()
-	defer e.varsm.Unlock()
-	e.vars[key] = value
+func (e *Env) lookupVar(key string) (string, bool) {
+	e.varsm.RLock()
+	v, ok := e.vars[key]
+	hidden := e.clear || e.unset[key]
+	e.varsm.RUnlock()
+	if ok {
+		return v, true
+	}
+	if e.strict {
+		e.varsm.Lock()
+		e.missing[key] = true
+		e.varsm.Unlock()
+	}
+	if hidden {
+		return "", false
+	}
+	return os.LookupEnv(key)
 }
 
-func (e *Env) writeVars(target map[string]string) {
+// mergeVars returns the variables from the system environ that haven't been
+// removed, overwritten with the mocked variables.
+func (e *Env) mergeVars(environ []string) map[string]string {
 	e.varsm.RLock()
 	defer e.varsm.RUnlock()
+	merged := make(map[string]string)
+	if !e.clear {
+		for _, kv := range environ {
+			k, v := envstr.Split(kv)
+			if !e.unset[k] {
+				merged[k] = v
+			}
+		}
+	}
 	for k, v := range e.vars {
-		target[k] = v
+		merged[k] = v
 	}
+	return merged
 }
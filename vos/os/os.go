@@ -1,48 +1,101 @@
 package os
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/internal/envstr"
 )
 
 func New() *Env {
 	return &Env{}
 }
 
-type Env struct{}
+// Env passes through to the os package. The streams can be set per instance,
+// which doesn't change the streams of the process.
+type Env struct {
+	m      sync.RWMutex
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
 
-func (*Env) Stdout() io.Writer {
+func (e *Env) Stdout() io.Writer {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	if e.stdout != nil {
+		return e.stdout
+	}
 	return os.Stdout
 }
 
-func (*Env) Setstdout(io.Writer) {
-	panic("Should only call this with vos.Mock()")
+// Setstdout sets the stdout of this Env, and of the commands it creates. Set
+// nil to use the stdout of the process again.
+func (e *Env) Setstdout(w io.Writer) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.stdout = w
 }
 
-func (*Env) Stderr() io.Writer {
+func (e *Env) Stderr() io.Writer {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	if e.stderr != nil {
+		return e.stderr
+	}
 	return os.Stderr
 }
 
-func (*Env) Setstderr(io.Writer) {
-	panic("Should only call this with vos.Mock()")
+// Setstderr sets the stderr of this Env, and of the commands it creates. Set
+// nil to use the stderr of the process again.
+func (e *Env) Setstderr(w io.Writer) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.stderr = w
 }
 
-func (*Env) Stdin() io.Reader {
+func (e *Env) Stdin() io.Reader {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	if e.stdin != nil {
+		return e.stdin
+	}
 	return os.Stdin
 }
 
-func (*Env) Setstdin(io.Reader) {
-	panic("Should only call this with vos.Mock()")
+// Setstdin sets the stdin of this Env, and of the commands it creates. Set
+// nil to use the stdin of the process again.
+func (e *Env) Setstdin(r io.Reader) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.stdin = r
 }
 
 func (*Env) Getenv(key string) string {
 	return os.Getenv(key)
 }
 
+func (*Env) LookupEnv(key string) (string, bool) {
+	return os.LookupEnv(key)
+}
+
 func (*Env) Setenv(key, value string) error {
 	return os.Setenv(key, value)
 }
 
+func (*Env) Unsetenv(key string) error {
+	return os.Unsetenv(key)
+}
+
+func (*Env) Clearenv() {
+	os.Clearenv()
+}
+
 func (*Env) Getwd() (string, error) {
 	return os.Getwd()
 }
@@ -51,7 +104,44 @@ func (*Env) Setwd(dir string) error {
 	return os.Chdir(dir)
 }
 
-// Environ returns a copy of strings representing the environment, in the form "key=value".
+// Environ returns a copy of strings representing the environment, in the form
+// "key=value", sorted by key.
 func (*Env) Environ() []string {
-	return os.Environ()
+	environ := os.Environ()
+	envstr.Sort(environ)
+	return environ
+}
+
+// Command returns a command that runs in the working dir of the process, with
+// the variables of the process and the streams of this Env.
+func (e *Env) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(ctx, name, args...)
+	cmd.Stdin = e.Stdin()
+	cmd.Stdout = e.Stdout()
+	cmd.Stderr = e.Stderr()
+	return cmd
+}
+
+func (*Env) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (*Env) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (*Env) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (*Env) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+func (*Env) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func (*Env) Abs(path string) (string, error) {
+	return filepath.Abs(path)
 }
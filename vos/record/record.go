@@ -0,0 +1,338 @@
+// Package record records the runs of the go tool made through a vos.Env to a
+// fixture file, and replays them without a go tool. Fixtures pin the output of
+// the go tool, so tools built on patsy can be tested in environments without a
+// Go toolchain, or against the behaviour of a particular Go version. Use
+// WithRoot to record fixtures that can be replayed from another directory,
+// e.g. a temporary copy of the test data.
+package record
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dave/patsy/vos"
+	"github.com/dave/patsy/vos/exec"
+	"github.com/dave/patsy/vos/internal/envstr"
+)
+
+var _ vos.Env = (*Recorder)(nil)
+var _ vos.Env = (*Player)(nil)
+
+// Program is the name of the program that is recorded and replayed. Other
+// programs are run by the wrapped Env as usual.
+const Program = "go"
+
+// Vars are the variables recorded with each run, and matched when replaying.
+// They change how the go tool resolves packages, but don't depend on the
+// machine. Variables that do, e.g. GOROOT, GOPATH, GOCACHE and GOTOOLCHAIN,
+// are not recorded, so they can differ between recording and replaying. In
+// GOPATH mode the GOPATH is still matched, as part of the dir of each run.
+var Vars = []string{
+	"CGO_ENABLED",
+	"GO111MODULE",
+	"GOARCH",
+	"GOEXPERIMENT",
+	"GOFLAGS",
+	"GOOS",
+	"GOWORK",
+}
+
+// Root is written in place of the root dir (see WithRoot) in recorded args,
+// dirs, variables and output.
+const Root = "$ROOT"
+
+// Invocation is a recorded run of the go tool.
+type Invocation struct {
+	Args     []string          `json:"args"` // not including the program name
+	Dir      string            `json:"dir"`
+	Env      map[string]string `json:"env,omitempty"` // the variables in Vars that are set
+	Stdout   string            `json:"stdout,omitempty"`
+	Stderr   string            `json:"stderr,omitempty"`
+	ExitCode int               `json:"exit_code,omitempty"`
+}
+
+// Option configures a Recorder or Player.
+type Option func(*config)
+
+type config struct {
+	root string
+}
+
+// WithRoot records the args, dirs, variables and output of runs under root
+// relative to root, with Root in its place, and replays them under root. A fixture
+// recorded with one root can be replayed with another.
+func WithRoot(root string) Option {
+	return func(c *config) {
+		c.root = filepath.Clean(root)
+	}
+}
+
+func newConfig(options []Option) config {
+	var c config
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// rebase replaces the root in s with Root.
+func (c config) rebase(s string) string {
+	if c.root == "" {
+		return s
+	}
+	return strings.Replace(s, c.root, Root, -1)
+}
+
+// resolve replaces Root in s with the root.
+func (c config) resolve(s string) string {
+	if c.root == "" {
+		return s
+	}
+	return strings.Replace(s, Root, c.root, -1)
+}
+
+// fixture is the format of a fixture file.
+type fixture struct {
+	Invocations []Invocation `json:"invocations"`
+}
+
+// Recorder is an Env that runs the go tool with the Env it wraps, and records
+// each completed run. Runs that are stopped by their context are not recorded.
+type Recorder struct {
+	vos.Env
+	config      config
+	m           sync.Mutex
+	invocations []Invocation
+}
+
+// New returns a Recorder wrapping env.
+func New(env vos.Env, options ...Option) *Recorder {
+	return &Recorder{Env: env, config: newConfig(options)}
+}
+
+// Command returns a command that records the run if the program is the go
+// tool.
+func (r *Recorder) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := r.Env.Command(ctx, name, args...)
+	if filepath.Base(name) != Program {
+		return cmd
+	}
+	return wrap(exec.Handled(ctx, r.run, name, args...), cmd)
+}
+
+func (r *Recorder) run(ctx context.Context, cmd *exec.Cmd) error {
+	real := r.Env.Command(ctx, cmd.Path, cmd.Args[1:]...)
+	real.Dir = cmd.Dir
+	real.Env = cmd.Env
+	real.Stdin = cmd.Stdin
+	var stdout, stderr bytes.Buffer
+	real.Stdout = io.MultiWriter(cmd.Stdout, &stdout)
+	real.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	err := real.Run()
+	if ctx.Err() != nil {
+		// the output is incomplete
+		return err
+	}
+	code, ok := exitCode(err)
+	if !ok {
+		// the go tool couldn't be run
+		return err
+	}
+	i := invocation(r.Env, cmd, r.config)
+	i.Stdout = r.config.rebase(stdout.String())
+	i.Stderr = r.config.rebase(stderr.String())
+	i.ExitCode = code
+	r.m.Lock()
+	r.invocations = append(r.invocations, i)
+	r.m.Unlock()
+	return err
+}
+
+// Invocations returns the runs recorded so far, in the order they completed.
+func (r *Recorder) Invocations() []Invocation {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]Invocation(nil), r.invocations...)
+}
+
+// Save writes the runs recorded so far to a fixture file.
+func (r *Recorder) Save(filename string) error {
+	b, err := json.MarshalIndent(fixture{Invocations: r.Invocations()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0666)
+}
+
+// Load reads the runs from a fixture file.
+func Load(filename string) ([]Invocation, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("record: decoding %s: %v", filename, err)
+	}
+	return f.Invocations, nil
+}
+
+// Player is an Env that serves the go tool from recorded runs instead of
+// running it. A run matches a recording with the same args, dir and variables
+// in Vars, so those variables should be the same as when the runs were
+// recorded. Matching recordings are served in the order they were recorded,
+// and the last one is repeated. Runs without a matching recording fail.
+type Player struct {
+	vos.Env
+	config      config
+	m           sync.Mutex
+	invocations []Invocation
+	served      map[int]bool
+}
+
+// Replay returns a Player wrapping env that serves the runs in invocations.
+func Replay(env vos.Env, invocations []Invocation, options ...Option) *Player {
+	return &Player{Env: env, config: newConfig(options), invocations: invocations, served: make(map[int]bool)}
+}
+
+// Open returns a Player wrapping env that serves the runs from a fixture file.
+func Open(env vos.Env, filename string, options ...Option) (*Player, error) {
+	invocations, err := Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Replay(env, invocations, options...), nil
+}
+
+// Command returns a command that is served from the recorded runs if the
+// program is the go tool.
+func (p *Player) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := p.Env.Command(ctx, name, args...)
+	if filepath.Base(name) != Program {
+		return cmd
+	}
+	return wrap(exec.Handled(ctx, p.run, name, args...), cmd)
+}
+
+func (p *Player) run(ctx context.Context, cmd *exec.Cmd) error {
+	i, ok := p.next(invocation(p.Env, cmd, p.config))
+	if !ok {
+		err := fmt.Errorf("record: no recording of go %s in %s", strings.Join(cmd.Args[1:], " "), cmd.Dir)
+		fmt.Fprintln(cmd.Stderr, err)
+		return err
+	}
+	if _, err := io.WriteString(cmd.Stdout, p.config.resolve(i.Stdout)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(cmd.Stderr, p.config.resolve(i.Stderr)); err != nil {
+		return err
+	}
+	if i.ExitCode != 0 {
+		return &exec.ExitError{Code: i.ExitCode}
+	}
+	return nil
+}
+
+// next returns the first recording matching run that hasn't been served, or
+// else the last recording matching run.
+func (p *Player) next(run Invocation) (Invocation, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	last := -1
+	for n, i := range p.invocations {
+		if !matches(i, run) {
+			continue
+		}
+		if !p.served[n] {
+			p.served[n] = true
+			return i, true
+		}
+		last = n
+	}
+	if last < 0 {
+		return Invocation{}, false
+	}
+	return p.invocations[last], true
+}
+
+func matches(a, b Invocation) bool {
+	if a.Dir != b.Dir || len(a.Args) != len(b.Args) || len(a.Env) != len(b.Env) {
+		return false
+	}
+	for n := range a.Args {
+		if a.Args[n] != b.Args[n] {
+			return false
+		}
+	}
+	for k, v := range a.Env {
+		if bv, ok := b.Env[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// wrap returns cmd with the dir, variables and streams of the command from the
+// wrapped Env.
+func wrap(cmd, from *exec.Cmd) *exec.Cmd {
+	cmd.Dir = from.Dir
+	cmd.Env = from.Env
+	cmd.Stdin = from.Stdin
+	cmd.Stdout = from.Stdout
+	cmd.Stderr = from.Stderr
+	return cmd
+}
+
+// invocation returns the args, dir and variables in Vars of a run, rebased on
+// the root in c. An empty dir or nil environment is taken from env, as they
+// are for a real process.
+func invocation(env vos.Env, cmd *exec.Cmd, c config) Invocation {
+	i := Invocation{Args: make([]string, 0, len(cmd.Args)-1), Dir: cmd.Dir}
+	for _, arg := range cmd.Args[1:] {
+		i.Args = append(i.Args, c.rebase(arg))
+	}
+	if i.Dir == "" {
+		i.Dir, _ = env.Getwd()
+	}
+	i.Dir = c.rebase(i.Dir)
+	environ := cmd.Env
+	if environ == nil {
+		environ = env.Environ()
+	}
+	recorded := make(map[string]bool, len(Vars))
+	for _, k := range Vars {
+		recorded[k] = true
+	}
+	for _, kv := range environ {
+		k, v := envstr.Split(kv)
+		if recorded[k] {
+			if i.Env == nil {
+				i.Env = make(map[string]string)
+			}
+			i.Env[k] = c.rebase(v)
+		}
+	}
+	return i
+}
+
+// exitCode returns the exit code of a run, or false if err is not an exit
+// error.
+func exitCode(err error) (int, bool) {
+	switch err := err.(type) {
+	case nil:
+		return 0, true
+	case *osexec.ExitError:
+		return err.ExitCode(), true
+	case *exec.ExitError:
+		return err.Code, true
+	}
+	return 0, false
+}
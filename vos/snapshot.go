@@ -0,0 +1,90 @@
+package vos
+
+import (
+	"io"
+	"reflect"
+
+	"github.com/dave/patsy/vos/internal/envstr"
+)
+
+// State is the variables, working dir and streams of an Env, saved by
+// Snapshot.
+type State struct {
+	env    Env
+	vars   map[string]string
+	wd     string
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
+
+// Snapshot saves the variables, working dir and streams of env, so that test
+// helpers which change them can roll them back with Restore.
+func Snapshot(env Env) *State {
+	s := &State{
+		env:    env,
+		vars:   make(map[string]string),
+		stdout: env.Stdout(),
+		stderr: env.Stderr(),
+		stdin:  env.Stdin(),
+	}
+	for _, kv := range env.Environ() {
+		k, v := envstr.Split(kv)
+		s.vars[k] = v
+	}
+	s.wd, _ = env.Getwd()
+	return s
+}
+
+// Restore sets the variables, working dir and streams of the Env back to the
+// saved state. Variables set since the snapshot was taken are removed. Only
+// the values that have changed are set, so restoring an Env that is unchanged
+// does nothing.
+func (s *State) Restore() error {
+	for _, kv := range s.env.Environ() {
+		if k, _ := envstr.Split(kv); !s.has(k) {
+			if err := s.env.Unsetenv(k); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range s.vars {
+		if current, ok := s.env.LookupEnv(k); !ok || current != v {
+			if err := s.env.Setenv(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if wd, err := s.env.Getwd(); s.wd != "" && (err != nil || wd != s.wd) {
+		if err := s.env.Setwd(s.wd); err != nil {
+			return err
+		}
+	}
+	if !same(s.env.Stdout(), s.stdout) {
+		s.env.Setstdout(s.stdout)
+	}
+	if !same(s.env.Stderr(), s.stderr) {
+		s.env.Setstderr(s.stderr)
+	}
+	if !same(s.env.Stdin(), s.stdin) {
+		s.env.Setstdin(s.stdin)
+	}
+	return nil
+}
+
+func (s *State) has(key string) bool {
+	_, ok := s.vars[key]
+	return ok
+}
+
+// same reports whether two streams are the same. Streams of types that can't
+// be compared are never the same.
+func same(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
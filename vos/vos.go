@@ -1,30 +1,51 @@
 // Package vos is a virtual os tool. It allows mocking of the os.Environ,
-// os.Getenv and os.Getwd functions.
+// os.Getenv and os.Getwd functions, of filesystem access and of running
+// commands.
 package vos
 
 import (
+	"context"
 	"io"
+	stdos "os"
 
+	"github.com/dave/patsy/vos/exec"
 	"github.com/dave/patsy/vos/mock"
 	"github.com/dave/patsy/vos/os"
 )
 
-// Env provides an interface with methods similar to os.Environ, os.Getenv and
-// os.Getwd functions.
+// Env provides an interface with methods similar to os.Environ, os.Getenv,
+// os.LookupEnv, os.Unsetenv, os.Clearenv and os.Getwd functions. Environ is
+// sorted by key. The filesystem methods are similar to the functions of
+// the same name in the os, io/ioutil and path/filepath packages, and resolve
+// relative paths from Getwd. Command returns a command that runs in Getwd,
+// with the variables from Environ and the streams from Stdin, Stdout and
+// Stderr.
 type Env interface {
 	Environ() []string
 
 	Getenv(key string) string
+	LookupEnv(key string) (string, bool)
 	Getwd() (string, error)
 	Stdout() io.Writer
 	Stderr() io.Writer
 	Stdin() io.Reader
 
 	Setenv(key, value string) error
+	Unsetenv(key string) error
+	Clearenv()
 	Setwd(dir string) error
 	Setstdout(io.Writer)
 	Setstderr(io.Writer)
 	Setstdin(io.Reader)
+
+	Stat(name string) (stdos.FileInfo, error)
+	Lstat(name string) (stdos.FileInfo, error)
+	ReadDir(dirname string) ([]stdos.FileInfo, error)
+	ReadFile(filename string) ([]byte, error)
+	EvalSymlinks(path string) (string, error)
+	Abs(path string) (string, error)
+
+	Command(ctx context.Context, name string, args ...string) *exec.Cmd
 }
 
 var _ Env = (*os.Env)(nil)
@@ -36,8 +57,31 @@ func Os() Env {
 	return os.New()
 }
 
+// Passthrough returns an Env that passes through to the os package, but whose
+// variables, working dir and streams can be overridden without changing those
+// of the process. Use this in production to run the go tool with different
+// settings, or to send its output to a logger.
+func Passthrough() Env {
+	return Fork(os.New())
+}
+
 // Mock returns an Env that provides a mock for the os package. Use this in
 // testing.
 func Mock() Env {
 	return mock.New()
 }
+
+// Strict returns a mock Env that never falls through to the os package for
+// variables or the working dir. The environment starts with only vars, and
+// the working dir must be set with Setwd. Use this for hermetic tests.
+func Strict(vars map[string]string) Env {
+	return mock.NewStrict(vars)
+}
+
+// MockFS returns a mock Env whose filesystem methods use the in-memory file
+// tree fs. Use this to test filesystem logic without touching disk.
+func MockFS(fs *mock.FS) Env {
+	e := mock.New()
+	e.SetFS(fs)
+	return e
+}
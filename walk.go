@@ -0,0 +1,109 @@
+package patsy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/dave/patsy/vos"
+	"github.com/pkg/errors"
+)
+
+// Package is a package listed by WalkPackages.
+type Package struct {
+	ImportPath string
+	Dir        string
+	Name       string
+	Incomplete bool  // true if the package or one of its dependencies has an error
+	Err        error // the error loading the package, if any
+}
+
+// StopWalk can be returned by the func passed to WalkPackages to stop the walk
+// early without an error.
+var StopWalk = errors.New("stop walk")
+
+// WalkPackages calls fn for each package matching pattern, resolved from the
+// current working dir, as the go tool lists them. Unlike Dirs, the output is
+// not buffered, so the first packages are available immediately even for
+// patterns matching many packages. Packages that can't be loaded are passed to
+// fn with Err set. If fn returns an error the walk stops and that error is
+// returned, unless it is StopWalk.
+func WalkPackages(ctx context.Context, env vos.Env, pattern string, fn func(Package) error) error {
+	wd, err := env.Getwd()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return walkPackages(ctx, env, wd, []string{pattern}, fn)
+}
+
+// listedPackage is the subset of the output of `go list -json` used by
+// WalkPackages.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Name       string
+	Incomplete bool
+	Error      *struct {
+		Err string
+	}
+}
+
+// walkPackages runs `go list -json` in dir, and calls fn for each package as
+// it is decoded.
+func walkPackages(ctx context.Context, env vos.Env, dir string, patterns []string, fn func(Package) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	exe := env.Command(ctx, "go", append([]string{"list", "-e", "-json"}, patterns...)...)
+	exe.Dir = dir
+	stderr := &bytes.Buffer{}
+	exe.Stderr = stderr
+	out, err := exe.StdoutPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := exe.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// stop kills the go tool and waits for it to exit
+	stop := func() {
+		cancel()
+		_ = exe.Wait()
+	}
+
+	dec := json.NewDecoder(out)
+	for {
+		var l listedPackage
+		if err := dec.Decode(&l); err == io.EOF {
+			break
+		} else if err != nil {
+			stop()
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			return errors.Wrapf(err, "decoding go list output for %s", strings.Join(patterns, " "))
+		}
+		p := Package{ImportPath: l.ImportPath, Dir: l.Dir, Name: l.Name, Incomplete: l.Incomplete}
+		if l.Error != nil {
+			p.Err = errors.New(l.Error.Err)
+		}
+		if err := fn(p); err != nil {
+			stop()
+			if err == StopWalk {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if err := exe.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		}
+		return errors.Wrapf(err, "listing %s: %s", strings.Join(patterns, " "), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
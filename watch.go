@@ -0,0 +1,293 @@
+package patsy
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dave/patsy/vos"
+	"github.com/pkg/errors"
+)
+
+// DefaultPollInterval is the interval used by Watch when the polling fallback
+// is used.
+const DefaultPollInterval = time.Second
+
+// Op describes the kind of change in an Event.
+type Op int
+
+const (
+	// Created means a directory was created.
+	Created Op = iota + 1
+	// Removed means a directory was deleted.
+	Removed
+	// Renamed means a directory was moved or renamed. Dir is the old location.
+	Renamed
+	// Changed means the files inside a directory were created, deleted or
+	// written.
+	Changed
+)
+
+func (o Op) String() string {
+	switch o {
+	case Created:
+		return "created"
+	case Removed:
+		return "removed"
+	case Renamed:
+		return "renamed"
+	case Changed:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Event describes a change to a directory watched by the Cache.
+type Event struct {
+	Op  Op
+	Dir string
+}
+
+// watcher is implemented by inotify and the polling fallback.
+type watcher interface {
+	// add starts watching dir. Adding a dir that is already watched does
+	// nothing.
+	add(dir string) error
+	// run sends events to fn until ctx is done.
+	run(ctx context.Context, fn func(Event))
+}
+
+// Watch starts watching the directories resolved by the Cache, and evicts the
+// affected entries when package directories are created, renamed or deleted.
+// On Linux inotify is used, otherwise the directories are polled every
+// DefaultPollInterval. Watching stops when ctx is done.
+func (c *Cache) Watch(ctx context.Context) error {
+	w, err := newInotify()
+	if err != nil {
+		return c.Poll(ctx, DefaultPollInterval)
+	}
+	return c.watch(ctx, w)
+}
+
+// Poll is the same as Watch, but always polls the directories at the interval
+// provided. Note that polling can't detect files being written in place.
+func (c *Cache) Poll(ctx context.Context, interval time.Duration) error {
+	return c.watch(ctx, newPoller(c.env, interval))
+}
+
+// Subscribe registers fn to be called with every change event once the
+// affected entries have been evicted. Call the returned function to
+// unsubscribe.
+func (c *Cache) Subscribe(fn func(Event)) (cancel func()) {
+	c.watchm.Lock()
+	defer c.watchm.Unlock()
+	id := c.nextSub
+	c.nextSub++
+	c.subs[id] = fn
+	return func() {
+		c.watchm.Lock()
+		defer c.watchm.Unlock()
+		delete(c.subs, id)
+	}
+}
+
+func (c *Cache) watch(ctx context.Context, w watcher) error {
+	c.watchm.Lock()
+	if c.watcher != nil {
+		c.watchm.Unlock()
+		return errors.New("Cache is already watching")
+	}
+	c.watcher = w
+	c.watchm.Unlock()
+
+	for _, dir := range c.cachedDirs() {
+		c.watchDir(dir)
+	}
+
+	go func() {
+		w.run(ctx, c.changed)
+		c.watchm.Lock()
+		c.watcher = nil
+		c.watchm.Unlock()
+	}()
+	return nil
+}
+
+// watchDir adds a resolved package dir, and its parent so that renames and
+// deletes are noticed, to the watcher if the Cache is watching.
+func (c *Cache) watchDir(dir string) {
+	c.watchm.Lock()
+	w := c.watcher
+	c.watchm.Unlock()
+	if w == nil || !filepath.IsAbs(dir) {
+		return
+	}
+	dir = filepath.Clean(dir)
+	_ = w.add(dir)
+	_ = w.add(filepath.Dir(dir))
+}
+
+// changed evicts the entries affected by the event, and notifies subscribers.
+// Any event may be a change to the module configuration files, so they are
+// checked again on the next lookup.
+func (c *Cache) changed(e Event) {
+	c.recheck()
+	c.evict(e.Dir, e.Op != Changed)
+
+	c.watchm.Lock()
+	subs := make([]func(Event), 0, len(c.subs))
+	for _, fn := range c.subs {
+		subs = append(subs, fn)
+	}
+	c.watchm.Unlock()
+
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// cachedDirs returns all the package dirs the Cache has resolved.
+func (c *Cache) cachedDirs() []string {
+	var dirs []string
+	c.table(DirMethod).each(func(k entryKey, v interface{}) {
+		dirs = append(dirs, v.(string))
+	})
+	c.table(PathMethod).each(func(k entryKey, v interface{}) {
+		dirs = append(dirs, k.arg)
+	})
+	return dirs
+}
+
+// evict discards the entries for dir. If tree is true the entries for all
+// dirs under dir are discarded too. Dirs entries for wildcard patterns and not
+// found Dir errors are always discarded because any change in the tree can
+// affect them.
+func (c *Cache) evict(dir string, tree bool) {
+	dir = filepath.Clean(dir)
+	c.forget(filter{
+		dir: func(d string) bool {
+			d = filepath.Clean(d)
+			return d == dir || (tree && isUnder(d, dir))
+		},
+		wildcards: true,
+		store:     true,
+	})
+}
+
+// isUnder reports whether dir is inside parent. Both must be clean.
+func isUnder(dir, parent string) bool {
+	return strings.HasPrefix(dir, strings.TrimSuffix(parent, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// poller is the watcher used when inotify is not available. It compares the
+// modification time and subdirectories of each watched dir at an interval.
+type poller struct {
+	env      vos.Env
+	interval time.Duration
+	m        sync.Mutex
+	dirs     map[string]*pollState
+}
+
+type pollState struct {
+	mod     time.Time
+	subdirs map[string]bool
+}
+
+func newPoller(env vos.Env, interval time.Duration) *poller {
+	return &poller{
+		env:      env,
+		interval: interval,
+		dirs:     make(map[string]*pollState),
+	}
+}
+
+func (p *poller) add(dir string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.dirs[dir]; ok {
+		return nil
+	}
+	state, err := poll(p.env, dir)
+	if err != nil {
+		return err
+	}
+	p.dirs[dir] = state
+	return nil
+}
+
+func (p *poller) run(ctx context.Context, fn func(Event)) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, e := range p.scan() {
+				fn(e)
+			}
+		}
+	}
+}
+
+// scan polls every watched dir and returns the changes since the last scan.
+func (p *poller) scan() []Event {
+	p.m.Lock()
+	defer p.m.Unlock()
+	var events []Event
+	for dir, prev := range p.dirs {
+		state, err := poll(p.env, dir)
+		if err != nil {
+			delete(p.dirs, dir)
+			events = append(events, Event{Op: Removed, Dir: dir})
+			continue
+		}
+		p.dirs[dir] = state
+		if state.mod.Equal(prev.mod) {
+			continue
+		}
+		var structural bool
+		for name := range state.subdirs {
+			if !prev.subdirs[name] {
+				structural = true
+				events = append(events, Event{Op: Created, Dir: filepath.Join(dir, name)})
+			}
+		}
+		for name := range prev.subdirs {
+			if !state.subdirs[name] {
+				structural = true
+				events = append(events, Event{Op: Removed, Dir: filepath.Join(dir, name)})
+			}
+		}
+		if !structural {
+			events = append(events, Event{Op: Changed, Dir: dir})
+		}
+	}
+	return events
+}
+
+func poll(env vos.Env, dir string) (*pollState, error) {
+	s, err := env.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", dir)
+	}
+	infos, err := env.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	state := &pollState{
+		mod:     s.ModTime(),
+		subdirs: make(map[string]bool),
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			state.subdirs[info.Name()] = true
+		}
+	}
+	return state, nil
+}
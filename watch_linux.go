@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package patsy
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const inotifyMask = syscall.IN_ONLYDIR |
+	syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF
+
+// inotify is the watcher used on Linux.
+type inotify struct {
+	fd   int
+	f    *os.File
+	m    sync.Mutex
+	wds  map[int32]string
+	dirs map[string]int32
+}
+
+func newInotify() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &inotify{
+		fd:   fd,
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		wds:  make(map[int32]string),
+		dirs: make(map[string]int32),
+	}, nil
+}
+
+func (w *inotify) add(dir string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, ok := w.dirs[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	w.wds[int32(wd)] = dir
+	w.dirs[dir] = int32(wd)
+	return nil
+}
+
+// remove forgets the watch for a dir that has been deleted or moved.
+func (w *inotify) remove(wd int32) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	dir, ok := w.wds[wd]
+	if !ok {
+		return
+	}
+	_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+	delete(w.wds, wd)
+	delete(w.dirs, dir)
+}
+
+func (w *inotify) lookup(wd int32) (string, bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	dir, ok := w.wds[wd]
+	return dir, ok
+}
+
+func (w *inotify) watched() []string {
+	w.m.Lock()
+	defer w.m.Unlock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (w *inotify) run(ctx context.Context, fn func(Event)) {
+	// the fd is non-blocking so closing the file interrupts the pending read
+	go func() {
+		<-ctx.Done()
+		_ = w.f.Close()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(raw.Len)], "\x00"))
+			offset = nameStart + int(raw.Len)
+			for _, e := range w.events(raw.Wd, raw.Mask, name) {
+				fn(e)
+			}
+		}
+	}
+}
+
+// events converts a raw inotify event to change events.
+func (w *inotify) events(wd int32, mask uint32, name string) []Event {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// events have been lost, so everything watched may have changed
+		var events []Event
+		for _, dir := range w.watched() {
+			events = append(events, Event{Op: Changed, Dir: dir})
+		}
+		return events
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		return nil
+	}
+	dir, ok := w.lookup(wd)
+	if !ok {
+		return nil
+	}
+	switch {
+	case mask&syscall.IN_DELETE_SELF != 0:
+		w.remove(wd)
+		return []Event{{Op: Removed, Dir: dir}}
+	case mask&syscall.IN_MOVE_SELF != 0:
+		w.remove(wd)
+		return []Event{{Op: Renamed, Dir: dir}}
+	case mask&syscall.IN_ISDIR == 0:
+		return []Event{{Op: Changed, Dir: dir}}
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		return []Event{{Op: Created, Dir: filepath.Join(dir, name)}}
+	case mask&syscall.IN_DELETE != 0:
+		return []Event{{Op: Removed, Dir: filepath.Join(dir, name)}}
+	case mask&syscall.IN_MOVED_FROM != 0:
+		return []Event{{Op: Renamed, Dir: filepath.Join(dir, name)}}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package patsy
+
+import "github.com/pkg/errors"
+
+func newInotify() (watcher, error) {
+	return nil, errors.New("inotify is only supported on linux")
+}